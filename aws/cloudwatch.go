@@ -2,19 +2,19 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"github.com/soundcloud/sc-gaws/aws/credentials"
 	"github.com/soundcloud/sc-gaws/stats"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	cloudwatchEndpoint   = "https://monitoring.amazonaws.com/doc/2010-08-01"
+	cloudwatchService    = "monitoring"
 	cloudwatchApiVersion = "2010-08-01"
 	maxMetricsPerRequest = 20
 )
@@ -22,20 +22,76 @@ const (
 // AwsStatsPusher implements the StatsPusher interface to allow
 // pushing metrics to AWS Cloudwatch
 type AwsStatsPusher struct {
-	// AWS Credentials
-	Credentials credentials.CredentialsProvider
+	// AWS Credentials. Wrap implementations of the deprecated
+	// credentials.CredentialsProvider with credentials.NewProviderAdapter.
+	Credentials credentials.Provider
 
 	// Namespace for the metric e.g. bobone-cluster1, bobone-cluster2
 	Namespace string
+
+	// Region to push metrics to. Derived from Endpoint if that is set,
+	// defaults to us-east-1 otherwise.
+	Region string
+
+	// CloudWatch endpoint URL, e.g. http://localhost:4566 for LocalStack.
+	// Resolved from Region if not set.
+	Endpoint string
+
+	// Resolves the endpoint if not set. Defaults to DefaultEndpointResolver.
+	Resolver *EndpointResolver
+
+	// Retries failed requests. Defaults to DefaultRetryer.
+	Retryer *Retryer
+
+	// Channel the ClockSkew metric is sent to whenever the signing time is
+	// corrected for a skewed local clock. Should be buffered.
+	Metrics chan<- stats.Metric
 }
 
-// Push a slice of metrics to CloudWatch
+// Endpoint URL and region to push metrics to
+func (p AwsStatsPusher) endpoint() (endpoint string, region string, err error) {
+	// Leave the region blank for explicit endpoints, so that it is derived
+	// from their host when signing
+	region = p.Region
+	if p.Endpoint != "" {
+		return strings.TrimSuffix(p.Endpoint, "/"), region, nil
+	}
+	if region == "" {
+		region = defaultRegion
+	}
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = DefaultEndpointResolver
+	}
+	endpoint, err = resolver.Resolve(cloudwatchService, region)
+	return
+}
+
+// Push a slice of metrics to CloudWatch, logging errors
 func (p AwsStatsPusher) Push(metrics []stats.Metric) {
+	if err := p.PushMetrics(context.Background(), metrics); err != nil {
+		log.Printf("Pushing metrics failed with error: %s", err)
+	}
+}
+
+// Push a slice of metrics to CloudWatch in as many requests as needed.
+// Returns the error of the last failed request, an *Error if CloudWatch
+// rejected it, after attempting all of them.
+func (p AwsStatsPusher) PushMetrics(ctx context.Context, metrics []stats.Metric) error {
+	endpoint, region, err := p.endpoint()
+	if err != nil {
+		return err
+	}
+	client := NewQueryClient(endpoint, cloudwatchService, region, cloudwatchApiVersion, p.Credentials)
+	client.Retryer = p.Retryer
+	client.Metrics = p.Metrics
+
 	// make multiple requests to CloudWatch to send all the metrics
 	n := len(metrics) / maxMetricsPerRequest
 	if (len(metrics) % maxMetricsPerRequest) > 0 {
 		n = n + 1
 	}
+	var lastErr error
 	for i := 0; i < n; i++ {
 		var m []stats.Metric
 		if i == n-1 {
@@ -43,30 +99,56 @@ func (p AwsStatsPusher) Push(metrics []stats.Metric) {
 		} else {
 			m = metrics[(i * maxMetricsPerRequest):((i + 1) * maxMetricsPerRequest)]
 		}
-		urlStr := fmt.Sprintf("%s/?Action=PutMetricData&Version=%s&Namespace=%s&Timestamp=%s&%s", cloudwatchEndpoint, cloudwatchApiVersion, p.Namespace, url.QueryEscape(timeInRfc3339(time.Now())), marshalMetrics(m))
-		req, _ := http.NewRequest("GET", urlStr, nil)
-		sign(req, p.Credentials.GetCredentials())
-		client := http.Client{}
-		log.Printf("Pushing metrics: %s", req.URL)
-		res, err := client.Do(req)
-		if err != nil {
-			log.Printf("Pushing metrics failed with error: %s", err)
-		} else {
-			defer res.Body.Close()
-			if res.StatusCode != 200 {
-				body, _ := ioutil.ReadAll(res.Body)
-				log.Printf("Pushing metrics failed with status code %d: %s", res.StatusCode, body)
+		params := QueryParams{"Namespace": p.Namespace}
+		marshalMetrics(params, m, client.clockSkew().Offset())
+		log.Printf("Pushing %d metrics to %s", len(m), endpoint)
+		if err := client.Call(ctx, "PutMetricData", params, nil); err != nil {
+			if n > 1 {
+				log.Printf("Pushing metrics %d to %d of %d failed with error: %s", i*maxMetricsPerRequest+1, i*maxMetricsPerRequest+len(m), len(metrics), err)
 			}
+			lastErr = err
 		}
 	}
+	return lastErr
 }
 
-// Marshal metrics into a query string format for AWS Cloudwatch
-func marshalMetrics(metrics []stats.Metric) string {
-	metricsStr := make([]string, len(metrics))
+// Marshal metrics into the parameters of a CloudWatch PutMetricData request,
+// adding skew to their timestamps to correct for a skewed local clock
+func marshalMetrics(params QueryParams, metrics []stats.Metric, skew time.Duration) {
 	for i, m := range metrics {
-		metricsStr[i] = fmt.Sprintf("MetricData.member.%d.MetricName=%s&MetricData.member.%d.Value=%f&MetricData.member.%d.Timestamp=%s", i+1, m.Name, i+1, m.Value, i+1, url.QueryEscape(timeInRfc3339(m.Timestamp)))
-	}
+		prefix := fmt.Sprintf("MetricData.member.%d.", i+1)
+		params.Set(prefix+"MetricName", m.Name)
+		if len(m.Values) > 0 {
+			for j, v := range m.Values {
+				params.SetFloat(fmt.Sprintf("%sValues.member.%d", prefix, j+1), v)
+			}
+			for j, c := range m.Counts {
+				params.SetFloat(fmt.Sprintf("%sCounts.member.%d", prefix, j+1), c)
+			}
+		} else if s := m.Statistics; s != nil {
+			params.SetFloat(prefix+"StatisticValues.SampleCount", s.SampleCount)
+			params.SetFloat(prefix+"StatisticValues.Sum", s.Sum)
+			params.SetFloat(prefix+"StatisticValues.Minimum", s.Minimum)
+			params.SetFloat(prefix+"StatisticValues.Maximum", s.Maximum)
+		} else {
+			params.Set(prefix+"Value", strconv.FormatFloat(float64(m.Value), 'f', -1, 32))
+		}
+		params.SetTime(prefix+"Timestamp", m.Timestamp.Add(skew))
+		if m.Unit != "" {
+			params.Set(prefix+"Unit", m.Unit)
+		}
+		if r := m.Resolution(); r > 0 {
+			params.SetInt(prefix+"StorageResolution", int64(r))
+		}
 
-	return strings.Join(metricsStr, "&")
+		names := make([]string, 0, len(m.Dimensions))
+		for name := range m.Dimensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for j, name := range names {
+			params.Set(fmt.Sprintf("%sDimensions.member.%d.Name", prefix, j+1), name)
+			params.Set(fmt.Sprintf("%sDimensions.member.%d.Value", prefix, j+1), m.Dimensions[name])
+		}
+	}
 }
@@ -0,0 +1,210 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"github.com/soundcloud/sc-gaws/stats"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushToEndpoint(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests = append(requests, r)
+	}))
+	defer server.Close()
+
+	p := AwsStatsPusher{
+		Credentials: credentials.NewIamUserCredentials("AKID", "SECRET"),
+		Namespace:   "test",
+		Region:      "eu-west-1",
+		Endpoint:    server.URL,
+	}
+	p.Push([]stats.Metric{{Name: "Requests", Value: 1, Unit: "Count", Timestamp: time.Now()}})
+
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(requests))
+	}
+	req := requests[0]
+	if req.Method != "POST" || req.PostForm.Get("Action") != "PutMetricData" || req.PostForm.Get("MetricData.member.1.MetricName") != "Requests" {
+		t.Fatalf("Unexpected request: %s %v", req.Method, req.PostForm)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "/eu-west-1/monitoring/aws4_request") {
+		t.Fatalf("Expected request signed for monitoring in eu-west-1, got %s", auth)
+	}
+}
+
+func TestPusherEndpoint(t *testing.T) {
+	endpoint, region, err := AwsStatsPusher{}.endpoint()
+	if err != nil || endpoint != "https://monitoring.us-east-1.amazonaws.com" || region != "us-east-1" {
+		t.Fatalf("Unexpected default endpoint %s in %s: %v", endpoint, region, err)
+	}
+
+	p := AwsStatsPusher{Region: "cn-north-1", Resolver: &EndpointResolver{UseDualStack: true}}
+	endpoint, _, err = p.endpoint()
+	if err != nil || endpoint != "https://monitoring.cn-north-1.api.amazonwebservices.com.cn" {
+		t.Fatalf("Unexpected endpoint %s: %v", endpoint, err)
+	}
+
+	// Region derived from the host when signing
+	p = AwsStatsPusher{Endpoint: "https://monitoring.eu-west-1.amazonaws.com/"}
+	endpoint, region, err = p.endpoint()
+	if err != nil || endpoint != "https://monitoring.eu-west-1.amazonaws.com" || region != "" {
+		t.Fatalf("Unexpected endpoint %s in %q: %v", endpoint, region, err)
+	}
+}
+
+func TestPushMetricsError(t *testing.T) {
+	server, _ := newTestQueryServer(t, http.StatusForbidden,
+		`<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>Not allowed</Message></Error><RequestId>abc</RequestId></ErrorResponse>`)
+	p := AwsStatsPusher{
+		Credentials: credentials.NewIamUserCredentials("AKID", "SECRET"),
+		Namespace:   "test",
+		Endpoint:    server.URL,
+	}
+
+	err := p.PushMetrics(context.Background(), []stats.Metric{{Name: "Requests", Value: 1, Unit: "Count", Timestamp: time.Now()}})
+	var awsErr *Error
+	if !errors.As(err, &awsErr) || awsErr.Code != "AccessDenied" || !awsErr.ClientError() {
+		t.Fatalf("Expected AccessDenied client error, got %v", err)
+	}
+}
+
+func TestMarshalDimensions(t *testing.T) {
+	params := QueryParams{}
+	marshalMetrics(params, []stats.Metric{
+		{Name: "Requests", Value: 1},
+		{Name: "Latency", Value: 12.5, Unit: "Milliseconds", Dimensions: map[string]string{"Host": "web-1", "Cluster": "bobone"}},
+	}, 0)
+
+	expected := map[string]string{
+		"MetricData.member.2.Dimensions.member.1.Name":  "Cluster",
+		"MetricData.member.2.Dimensions.member.1.Value": "bobone",
+		"MetricData.member.2.Dimensions.member.2.Name":  "Host",
+		"MetricData.member.2.Dimensions.member.2.Value": "web-1",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Fatalf("Expected %s to be %s, got %s", k, v, params[k])
+		}
+	}
+	if _, ok := params["MetricData.member.1.Dimensions.member.1.Name"]; ok {
+		t.Fatal("Expected no dimensions for metric without dimensions")
+	}
+}
+
+func TestMarshalStatistics(t *testing.T) {
+	params := QueryParams{}
+	marshalMetrics(params, []stats.Metric{
+		{Name: "Latency", Value: 25, Unit: "Milliseconds", Statistics: &stats.StatisticSet{SampleCount: 4, Sum: 100, Minimum: 5, Maximum: 62.5}},
+	}, 0)
+
+	expected := map[string]string{
+		"MetricData.member.1.StatisticValues.SampleCount": "4",
+		"MetricData.member.1.StatisticValues.Sum":         "100",
+		"MetricData.member.1.StatisticValues.Minimum":     "5",
+		"MetricData.member.1.StatisticValues.Maximum":     "62.5",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Fatalf("Expected %s to be %s, got %s", k, v, params[k])
+		}
+	}
+	if _, ok := params["MetricData.member.1.Value"]; ok {
+		t.Fatal("Expected no value along with statistics")
+	}
+}
+
+func TestMarshalHistogram(t *testing.T) {
+	params := QueryParams{}
+	marshalMetrics(params, []stats.Metric{
+		{Name: "Latency", Unit: "Milliseconds", Values: []float64{5, 20.5}, Counts: []float64{3, 1}, Statistics: &stats.StatisticSet{SampleCount: 4}},
+	}, 0)
+
+	expected := map[string]string{
+		"MetricData.member.1.Values.member.1": "5",
+		"MetricData.member.1.Values.member.2": "20.5",
+		"MetricData.member.1.Counts.member.1": "3",
+		"MetricData.member.1.Counts.member.2": "1",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Fatalf("Expected %s to be %s, got %s", k, v, params[k])
+		}
+	}
+	if _, ok := params["MetricData.member.1.StatisticValues.SampleCount"]; ok {
+		t.Fatal("Expected no statistics along with values")
+	}
+}
+
+func TestMarshalStorageResolution(t *testing.T) {
+	params := QueryParams{}
+	marshalMetrics(params, []stats.Metric{
+		{Name: "Requests", Value: 1},
+		{Name: "Bytes", Value: 2, StorageResolution: 1},
+		{Name: "Errors", Value: 3, StorageResolution: 10},
+		{Name: "Latency", Value: 4, StorageResolution: 300},
+	}, 0)
+
+	if _, ok := params["MetricData.member.1.StorageResolution"]; ok {
+		t.Fatal("Expected no storage resolution for standard metric")
+	}
+	// CloudWatch accepts only 1 and 60
+	for i, expected := range []string{"1", "1", "60"} {
+		if v := params[fmt.Sprintf("MetricData.member.%d.StorageResolution", i+2)]; v != expected {
+			t.Fatalf("Expected storage resolution %s for metric %d, got %s", expected, i+2, v)
+		}
+	}
+}
+
+// Implements only the deprecated CredentialsProvider interface
+type legacyProvider struct{}
+
+func (legacyProvider) GetCredentials() *credentials.Credentials {
+	return &credentials.Credentials{AccessKeyId: "LEGACY", SecretAccessKey: "SECRET"}
+}
+
+func TestPushWithLegacyProvider(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+	}))
+	defer server.Close()
+
+	p := AwsStatsPusher{Credentials: credentials.NewProviderAdapter(legacyProvider{}), Namespace: "test", Endpoint: server.URL}
+	if err := p.PushMetrics(context.Background(), []stats.Metric{{Name: "Requests", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if auth := requests[0].Header.Get("Authorization"); !strings.Contains(auth, "Credential=LEGACY/") {
+		t.Fatalf("Expected request signed with legacy credentials, got %s", auth)
+	}
+}
+
+func TestPushWithChain(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+	}))
+	defer server.Close()
+
+	chain, err := credentials.NewChain(func() (credentials.Provider, error) {
+		return credentials.NewIamUserCredentials("CHAIN", "SECRET"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := AwsStatsPusher{Credentials: chain, Namespace: "test", Endpoint: server.URL}
+	if err := p.PushMetrics(context.Background(), []stats.Metric{{Name: "Requests", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if auth := requests[0].Header.Get("Authorization"); !strings.Contains(auth, "Credential=CHAIN/") {
+		t.Fatalf("Expected request signed with chain credentials, got %s", auth)
+	}
+}
@@ -0,0 +1,79 @@
+package credentials
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ProviderFunc initialises a Provider, returning an error if the
+// credentials it provides are not available in the current environment.
+type ProviderFunc func() (Provider, error)
+
+// NewChain tries each of providers in order and returns the first
+// Provider that could be initialised. Returns an error listing
+// why each of them failed if none could.
+func NewChain(providers ...ProviderFunc) (Provider, error) {
+	return NewChainWithHooks(NopHooks{}, providers...)
+}
+
+// NewChainWithHooks is like NewChain, notifying hooks about every provider
+// that is not available.
+func NewChainWithHooks(hooks Hooks, providers ...ProviderFunc) (Provider, error) {
+	var errs []string
+	for i, provider := range providers {
+		creds, err := provider()
+		if err == nil {
+			return creds, nil
+		}
+		log.Printf("Credentials provider %d of %d not available: %s", i+1, len(providers), err)
+		hooks.ChainFallback(i, err)
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("No credentials provider available: %s", strings.Join(errs, "; "))
+}
+
+// NewDefaultChain looks for credentials in the places they are usually
+// found, so that the same binary can run on a laptop, in CI and on EC2.
+// In order:
+//
+//   - The AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+//     environment variables
+//   - Static keys or credential_process of the profile named by AWS_PROFILE
+//     (or the default profile) in the shared credentials and config files
+//   - Credentials for the task role of an ECS or Fargate container
+//   - Credentials for the role attached to the EC2 instance profile
+func NewDefaultChain() (Provider, error) {
+	return NewDefaultChainWithHooks(NopHooks{})
+}
+
+// NewDefaultChainWithHooks is like NewDefaultChain, notifying hooks about
+// every provider that is not available and about refreshes of the
+// temporary credentials of containers and instance profiles.
+func NewDefaultChainWithHooks(hooks Hooks) (Provider, error) {
+	refresh := RefreshOptions{Hooks: hooks}
+	return NewChainWithHooks(hooks,
+		func() (Provider, error) {
+			creds, err := NewEnvCredentials()
+			if err != nil {
+				return nil, err
+			}
+			return creds, nil
+		},
+		func() (Provider, error) { return newSharedProfileCredentials("") },
+		func() (Provider, error) {
+			creds, err := NewContainerCredentialsWithOptions(refresh)
+			if err != nil {
+				return nil, err
+			}
+			return creds, nil
+		},
+		func() (Provider, error) {
+			creds, err := NewDiscoveredIamRoleCredentialsWithOptions(MetadataOptions{Refresh: refresh})
+			if err != nil {
+				return nil, err
+			}
+			return creds, nil
+		},
+	)
+}
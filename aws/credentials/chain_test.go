@@ -0,0 +1,84 @@
+package credentials
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Set environment variables for the duration of a test. An empty value
+// unsets the variable.
+func setenv(t *testing.T, env map[string]string) {
+	for k, v := range env {
+		old, ok := os.LookupEnv(k)
+		if v == "" {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, v)
+		}
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	setenv(t, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+		"AWS_SESSION_TOKEN":     "TOKEN",
+	})
+
+	provider, err := NewEnvCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := retrieve(t, provider)
+	if creds.AccessKeyId != "AKID" || creds.SecretAccessKey != "SECRET" || creds.Token != "TOKEN" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	setenv(t, map[string]string{"AWS_SECRET_ACCESS_KEY": ""})
+	if _, err := NewEnvCredentials(); err == nil {
+		t.Fatal("Expected error without AWS_SECRET_ACCESS_KEY")
+	}
+}
+
+func TestChainReturnsFirstAvailableProvider(t *testing.T) {
+	var tried []string
+	unavailable := func() (Provider, error) {
+		tried = append(tried, "unavailable")
+		return nil, errors.New("not here")
+	}
+	available := func() (Provider, error) {
+		tried = append(tried, "available")
+		return NewIamUserCredentials("AKID", "SECRET"), nil
+	}
+
+	provider, err := NewChain(unavailable, available, unavailable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieve(t, provider).AccessKeyId != "AKID" {
+		t.Fatalf("Unexpected credentials: %+v", retrieve(t, provider))
+	}
+	if strings.Join(tried, ",") != "unavailable,available" {
+		t.Fatalf("Expected providers to be tried in order until one is available, tried %v", tried)
+	}
+}
+
+func TestChainWithoutAvailableProvider(t *testing.T) {
+	first := func() (Provider, error) { return nil, errors.New("first failed") }
+	second := func() (Provider, error) { return nil, errors.New("second failed") }
+
+	_, err := NewChain(first, second)
+	if err == nil || !strings.Contains(err.Error(), "first failed") || !strings.Contains(err.Error(), "second failed") {
+		t.Fatalf("Expected error listing all failures, got %v", err)
+	}
+}
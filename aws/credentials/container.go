@@ -0,0 +1,150 @@
+// Implements a way to fetch temporary AWS credentials for the task role of a
+// container running on ECS or Fargate.
+//
+// The ECS agent exposes the credentials on an endpoint whose location is
+// passed to the container in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI, or in
+// AWS_CONTAINER_CREDENTIALS_FULL_URI together with an authorization token.
+// Credentials are refreshed before they expire in the same way as EC2 role
+// credentials.
+//
+// More info: http://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-iam-roles.html
+
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Host of the ECS agent's credentials endpoint for relative URIs
+	containerCredentialsHost    = "http://169.254.170.2"
+	containerCredentialsTimeout = 5 * time.Second
+)
+
+// Hosts, besides loopback addresses, that full URIs may point to over plain
+// HTTP: the ECS and EKS Pod Identity agents.
+var containerCredentialsAllowedHosts = []string{"169.254.170.2", "169.254.170.23", "fd00:ec2::23"}
+
+type containerEndpoint struct {
+	url       string
+	token     string // Authorization token, if any
+	tokenFile string // File to read the authorization token from, if any
+	client    *http.Client
+}
+
+// Initialise credentials from the ECS container credentials endpoint. Returns
+// an error if the endpoint is not configured in the environment or
+// credentials could not be fetched.
+//
+// The endpoint is read from AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI. An authorization token for full URIs
+// is read from AWS_CONTAINER_AUTHORIZATION_TOKEN, or from the file named by
+// AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE.
+func NewContainerCredentials() (*RefreshingCredentials, error) {
+	return NewContainerCredentialsWithOptions(RefreshOptions{})
+}
+
+// Initialise credentials from the ECS container credentials endpoint,
+// refreshing them as configured by opts.
+func NewContainerCredentialsWithOptions(opts RefreshOptions) (*RefreshingCredentials, error) {
+	endpoint, err := containerEndpointFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return startRefresher(&ec2MetadataCredentials{fetch: endpoint.fetch}, opts)
+}
+
+func containerEndpointFromEnv() (*containerEndpoint, error) {
+	endpoint := &containerEndpoint{client: &http.Client{Timeout: containerCredentialsTimeout}}
+
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint.url = containerCredentialsHost + relative
+		return endpoint, nil
+	}
+
+	full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if full == "" {
+		return nil, errors.New("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI must be set")
+	}
+	if err := validateContainerURI(full); err != nil {
+		return nil, err
+	}
+	endpoint.url = full
+	endpoint.token = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	endpoint.tokenFile = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+	return endpoint, nil
+}
+
+// Full URIs have to use HTTPS, or point to a loopback address or one of the
+// container agents.
+func validateContainerURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("Invalid container credentials URI %s: %v", uri, err)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		for _, allowed := range containerCredentialsAllowedHosts {
+			if host == allowed {
+				return nil
+			}
+		}
+		if host == "localhost" {
+			return nil
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return nil
+		}
+		return fmt.Errorf("Container credentials URI %s must use HTTPS or a loopback host", uri)
+	}
+	return fmt.Errorf("Unsupported scheme for container credentials URI %s", uri)
+}
+
+// Fetch credentials from the container endpoint
+func (e *containerEndpoint) fetch(ctx context.Context, creds *ec2MetadataCredentials) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", e.url, nil)
+	if err != nil {
+		return err
+	}
+
+	token := e.token
+	if e.tokenFile != "" {
+		// The token file may be rotated, so read it on every fetch
+		b, err := ioutil.ReadFile(e.tokenFile)
+		if err != nil {
+			return fmt.Errorf("Cannot read container authorization token: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	log.Printf("Querying container endpoint for credentials: %s", e.url)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Container credentials endpoint returned status %d\n%s", resp.StatusCode, body)
+	}
+
+	return creds.update(body, false)
+}
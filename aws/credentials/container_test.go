@@ -0,0 +1,160 @@
+package credentials
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stand-in for the ECS agent's credentials endpoint, handing out credentials
+// that expire after ttl to requests carrying the expected token.
+type fakeContainerEndpoint struct {
+	mu      sync.Mutex
+	token   string
+	ttl     time.Duration
+	fetches int
+}
+
+func (f *fakeContainerEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != f.token {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	f.fetches++
+	fmt.Fprintf(w, `{"RoleArn":"arn:aws:iam::123456789012:role/task","AccessKeyId":"AKID%d","SecretAccessKey":"SECRET","Token":"TOKEN","Expiration":"%s"}`,
+		f.fetches, time.Now().Add(f.ttl).UTC().Format(time.RFC3339Nano))
+}
+
+func (f *fakeContainerEndpoint) fetchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetches
+}
+
+func TestContainerCredentials(t *testing.T) {
+	f := &fakeContainerEndpoint{token: "auth-token", ttl: time.Hour}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	setenv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     server.URL + "/creds",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "auth-token",
+	})
+
+	provider, err := NewContainerCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := retrieve(t, provider)
+	if creds.AccessKeyId != "AKID1" || creds.SecretAccessKey != "SECRET" || creds.Token != "TOKEN" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+}
+
+func TestContainerCredentialsTokenFile(t *testing.T) {
+	f := &fakeContainerEndpoint{token: "token-from-file", ttl: time.Hour}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(tokenFile, []byte("token-from-file\n"), 0600)
+	setenv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     server.URL,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": tokenFile,
+	})
+
+	if _, err := NewContainerCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.token = "wrong"
+	f.mu.Unlock()
+	if _, err := NewContainerCredentials(); err == nil {
+		t.Fatal("Expected error when the endpoint rejects the token")
+	}
+}
+
+func TestContainerCredentialsRefresh(t *testing.T) {
+	f := &fakeContainerEndpoint{ttl: shortLifetime}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	setenv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     server.URL,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "",
+	})
+
+	signal := newRefreshSignal()
+	provider, err := NewContainerCredentialsWithOptions(RefreshOptions{Hooks: signal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	signal.wait(t)
+	if f.fetchCount() < 2 {
+		t.Fatal("Expected credentials to be refreshed before they expire")
+	}
+	if retrieve(t, provider).AccessKeyId == "AKID1" {
+		t.Fatal("Expected refreshed credentials to be returned")
+	}
+}
+
+func TestContainerCredentialsFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Code":"AccessDenied","Message":"Task role not found"}`)
+	}))
+	defer server.Close()
+	setenv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     server.URL,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "",
+	})
+
+	if _, err := NewContainerCredentials(); err == nil {
+		t.Fatal("Expected error when the endpoint reports a failure")
+	}
+}
+
+func TestContainerCredentialsNotConfigured(t *testing.T) {
+	setenv(t, map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     "",
+	})
+	if _, err := NewContainerCredentials(); err == nil {
+		t.Fatal("Expected error without container credentials endpoint")
+	}
+}
+
+func TestValidateContainerURI(t *testing.T) {
+	valid := []string{
+		"https://credentials.example.com/creds",
+		"http://127.0.0.1:51679/creds",
+		"http://localhost/creds",
+		"http://[::1]/creds",
+		"http://169.254.170.23/v1/credentials",
+	}
+	for _, uri := range valid {
+		if err := validateContainerURI(uri); err != nil {
+			t.Errorf("Expected %s to be allowed: %s", uri, err)
+		}
+	}
+
+	invalid := []string{"http://example.com/creds", "ftp://127.0.0.1/creds"}
+	for _, uri := range invalid {
+		if err := validateContainerURI(uri); err == nil {
+			t.Errorf("Expected %s to be rejected", uri)
+		}
+	}
+}
@@ -1,37 +1,55 @@
 // Provides a common interface to deal with different types of AWS Credentials.
 //
-// This package supports two different of credentials
+// This package supports these types of credentials
+//
+// * Regular IAM User credentials, set explicitly, in the environment or in
+//   the shared credentials file.
 //
-// * Regular IAM User credentials
-
 // * Temporary credentials  which are associated with an IAM Role, fetched
-//   from the EC2 Metadata Service.
+//   from the EC2 Metadata Service or the ECS container credentials endpoint.
 //   More info about temporary credentials: http://docs.aws.amazon.com/STS/latest/UsingSTS/UsingTokens.html
 
 package credentials
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws/ec2metadata"
 	"sync"
+	"time"
 )
 
 // Credentials type to hold AWS Credentials
 type Credentials struct {
 	AccessKeyId     string
 	SecretAccessKey string
-	Token           string // Security token if applicable. Blank if not used
+	Token           string    // Security token if applicable. Blank if not used
+	Expiration      time.Time // Expiry of temporary credentials. Zero if they do not expire
+}
+
+// Provider is an interface that wraps a method Retrieve which can be called
+// to obtain AWS Credentials that can be used to authenticate against AWS
+// Services. It returns an error if no valid credentials are available, e.g.
+// because temporary credentials expired and could not be refreshed.
+type Provider interface {
+	Retrieve(ctx context.Context) (Credentials, error)
 }
 
 // CredentialsProvider is an interface that wraps a method Credentials which
 // can be called to obtain AWS Credentials that can be used to authenticate
 // against AWS Services
+//
+// Deprecated: It cannot report failures to obtain credentials. Implement
+// Provider instead, or wrap existing implementations with
+// NewProviderAdapter. All providers in this package implement both.
 type CredentialsProvider interface {
-	// FIXME possibly return an error if credentials cannot be retrieved
-	// for some reason.
 	GetCredentials() *Credentials
 }
 
 // Credentials obtained from the EC2 Metadata API contain some
-// additional information.
+// additional information. The ECS container credentials endpoint returns
+// the same format.
 type ec2MetadataCredentials struct {
 	Code            string
 	LastUpdated     string
@@ -40,7 +58,26 @@ type ec2MetadataCredentials struct {
 	SecretAccessKey string
 	Token           string
 	Expiration      string
-	mu              *sync.Mutex // Mutex to synchronize credential refresh
+	mu              *sync.Mutex         // Mutex to synchronize credential refresh
+	fetchMu         fetchLock           // Serializes fetches
+	metadata        *ec2metadata.Client // Client used to query the EC2 Metadata API
+	role            string              // Role to fetch credentials for
+	discoverRole    bool                // Look up role from the instance profile on every refresh
+
+	// Fetches fresh credentials into c, called through refresh
+	fetch func(ctx context.Context, c *ec2MetadataCredentials) error
+
+	fetched         time.Time // When the credentials were last fetched
+	expiredReported string    // Expiration hooks were last notified about
+	failures        int       // Consecutive failed fetches
+
+	opts       RefreshOptions     // How the credentials are refreshed
+	ctx        context.Context    // Context of the background refresh
+	cancel     context.CancelFunc // Stops the background refresh
+	ready      chan struct{}      // Closed after the first successful fetch
+	readyOnce  sync.Once
+	reschedule chan struct{} // Signals the background refresh to reschedule
+	done       chan struct{} // Closed when the background refresh stopped
 }
 
 // Simply returns itself
@@ -48,6 +85,11 @@ func (c *Credentials) GetCredentials() *Credentials {
 	return c
 }
 
+// Simply returns a copy of itself
+func (c *Credentials) Retrieve(ctx context.Context) (Credentials, error) {
+	return *c, nil
+}
+
 // Returns a copy of the credentials obtained from the EC2 Metadata
 // API.
 //
@@ -55,28 +97,235 @@ func (c *Credentials) GetCredentials() *Credentials {
 // current goroutine and the goroutine that is fetching the
 // credentials periodically from the EC2 Metadata API.
 func (c *ec2MetadataCredentials) GetCredentials() *Credentials {
+	creds := c.current()
+	return &creds
+}
+
+// Returns a copy of the credentials obtained from the EC2 Metadata API. If
+// they expired, or are about to as configured by RefreshOptions.ExpiryMargin,
+// without the background refresh replacing them, fetching them is attempted
+// once more before returning an error.
+func (c *ec2MetadataCredentials) Retrieve(ctx context.Context) (Credentials, error) {
+	if err := ctx.Err(); err != nil {
+		return Credentials{}, err
+	}
+	creds := c.current()
+	if c.valid(creds) {
+		return creds, nil
+	}
+	c.checkExpired()
+	if !c.isReady() {
+		// Started asynchronously and no fetch succeeded yet
+		if err := c.refreshStale(ctx); err != nil {
+			return Credentials{}, fmt.Errorf("Credentials could not be fetched: %v", err)
+		}
+		return c.current(), nil
+	}
+
+	if err := c.refreshStale(ctx); err != nil {
+		return Credentials{}, fmt.Errorf("Credentials expire at %s and could not be refreshed: %v", creds.Expiration.Format(time.RFC3339), err)
+	}
+	return c.current(), nil
+}
+
+func (c *ec2MetadataCredentials) current() Credentials {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return &Credentials{AccessKeyId: c.AccessKeyId,
+	creds := Credentials{AccessKeyId: c.AccessKeyId,
 		SecretAccessKey: c.SecretAccessKey,
 		Token:           c.Token,
 	}
+	if c.Expiration != "" {
+		// Unparseable expiry times are treated as already expired
+		creds.Expiration, _ = time.Parse(time.RFC3339, c.Expiration)
+		if creds.Expiration.IsZero() {
+			creds.Expiration = time.Unix(0, 0)
+		}
+	}
+	return creds
+}
+
+// Whether creds were fetched and are valid for longer than the expiry margin
+func (c *ec2MetadataCredentials) valid(creds Credentials) bool {
+	return c.isReady() && (creds.Expiration.IsZero() || time.Now().Add(c.opts.ExpiryMargin).Before(creds.Expiration))
+}
+
+// fetchLock serializes fetches like a mutex, but waiting for it can be given
+// up when the context of the waiting caller is done. The zero value is
+// unlocked.
+type fetchLock struct {
+	once sync.Once
+	held chan struct{}
+}
+
+// Acquire the lock, or return the error of ctx if it is done first
+func (l *fetchLock) lock(ctx context.Context) error {
+	l.once.Do(func() { l.held = make(chan struct{}, 1) })
+	select {
+	case l.held <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *fetchLock) unlock() {
+	<-l.held
+}
+
+// Fetch fresh credentials, making sure only one fetch runs at a time
+func (c *ec2MetadataCredentials) refresh(ctx context.Context) error {
+	if err := c.fetchMu.lock(ctx); err != nil {
+		return err
+	}
+	defer c.fetchMu.unlock()
+	return c.fetchLocked(ctx)
+}
+
+// Fetch fresh credentials unless they were fetched while waiting for a
+// concurrent fetch, so that callers finding expired credentials at the same
+// time do not all fetch them
+func (c *ec2MetadataCredentials) refreshStale(ctx context.Context) error {
+	c.mu.Lock()
+	fetched := c.fetched
+	c.mu.Unlock()
+
+	if err := c.fetchMu.lock(ctx); err != nil {
+		return err
+	}
+	defer c.fetchMu.unlock()
+	c.mu.Lock()
+	refreshed := c.fetched.After(fetched)
+	c.mu.Unlock()
+	if refreshed || c.valid(c.current()) {
+		return nil
+	}
+	return c.fetchLocked(ctx)
+}
+
+// Fetch fresh credentials, with fetchMu held
+func (c *ec2MetadataCredentials) fetchLocked(ctx context.Context) error {
+	err := c.fetch(ctx, c)
+	if err != nil {
+		c.failures++
+		c.opts.Hooks.RefreshFailed(err, c.failures)
+		return err
+	}
+
+	c.failures = 0
+	c.mu.Lock()
+	c.fetched = time.Now()
+	c.mu.Unlock()
+	c.readyOnce.Do(func() { close(c.ready) })
+	c.opts.Hooks.RefreshSucceeded(c.current())
+	return nil
+}
+
+func (c *ec2MetadataCredentials) expiration() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Expiration
+}
+
+func (c *ec2MetadataCredentials) isReady() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Fetch fresh credentials immediately and reschedule the background refresh
+func (c *ec2MetadataCredentials) Refresh(ctx context.Context) error {
+	if err := c.refresh(ctx); err != nil {
+		return err
+	}
+	select {
+	case c.reschedule <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Block until credentials were fetched successfully once, or ctx is done
+func (c *ec2MetadataCredentials) Wait(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop refreshing credentials in the background and wait for it to finish
+func (c *ec2MetadataCredentials) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+type providerAdapter struct {
+	provider CredentialsProvider
+}
+
+// NewProviderAdapter wraps an implementation of the deprecated
+// CredentialsProvider interface to implement Provider. Implementations of
+// Provider are returned as they are.
+func NewProviderAdapter(p CredentialsProvider) Provider {
+	if provider, ok := p.(Provider); ok {
+		return provider
+	}
+	return &providerAdapter{p}
+}
+
+func (a *providerAdapter) Retrieve(ctx context.Context) (Credentials, error) {
+	if err := ctx.Err(); err != nil {
+		return Credentials{}, err
+	}
+	creds := a.provider.GetCredentials()
+	if creds == nil {
+		return Credentials{}, errors.New("No credentials returned by provider")
+	}
+	return *creds, nil
 }
 
 // Initialise regular IAM Credentials
-func NewIamUserCredentials(keyId string, secretKey string) CredentialsProvider {
+func NewIamUserCredentials(keyId string, secretKey string) *Credentials {
 	return &Credentials{AccessKeyId: keyId, SecretAccessKey: secretKey}
 }
 
 // Initialise role credentials. Returns an error if credentials could not be
 // initalized correctly.
-func NewIamRoleCredentials(role string) (CredentialsProvider, error) {
-	creds := &ec2MetadataCredentials{mu: &sync.Mutex{}}
-	err := fetchRoleCredentials(role, creds)
-	if err != nil {
-		return nil, err
-	}
+//
+// The EC2 Metadata API is queried with IMDSv2 session tokens, without falling
+// back to IMDSv1. Use NewIamRoleCredentialsWithOptions to change this.
+func NewIamRoleCredentials(role string) (*RefreshingCredentials, error) {
+	return NewIamRoleCredentialsWithOptions(role, MetadataOptions{})
+}
+
+// Initialise role credentials, querying the EC2 Metadata API as configured
+// by opts.
+func NewIamRoleCredentialsWithOptions(role string, opts MetadataOptions) (*RefreshingCredentials, error) {
+	return newIamRoleCredentials(&ec2MetadataCredentials{role: role}, opts)
+}
+
+// Initialise role credentials for the role attached to the instance profile.
+// The role is looked up again on every refresh, so changes to the instance
+// profile are picked up without restarting. Returns an error if no role is
+// attached or credentials could not be initialized correctly.
+func NewDiscoveredIamRoleCredentials() (*RefreshingCredentials, error) {
+	return NewDiscoveredIamRoleCredentialsWithOptions(MetadataOptions{})
+}
+
+// Initialise role credentials for the role attached to the instance profile,
+// querying the EC2 Metadata API as configured by opts.
+func NewDiscoveredIamRoleCredentialsWithOptions(opts MetadataOptions) (*RefreshingCredentials, error) {
+	return newIamRoleCredentials(&ec2MetadataCredentials{discoverRole: true}, opts)
+}
 
-	go credentialsRefresher(creds, role)
-	return creds, nil
+func newIamRoleCredentials(creds *ec2MetadataCredentials, opts MetadataOptions) (*RefreshingCredentials, error) {
+	creds.metadata = newMetadataClient(opts)
+	creds.fetch = refreshRoleCredentials
+	return startRefresher(creds, opts.Refresh)
 }
@@ -0,0 +1,176 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func retrieve(t *testing.T, p Provider) Credentials {
+	creds, err := p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieving credentials failed: %s", err)
+	}
+	return creds
+}
+
+// Implements only the deprecated CredentialsProvider interface
+type legacyProvider struct {
+	creds *Credentials
+}
+
+func (p legacyProvider) GetCredentials() *Credentials {
+	return p.creds
+}
+
+func TestProviderAdapter(t *testing.T) {
+	provider := NewProviderAdapter(legacyProvider{&Credentials{AccessKeyId: "AKID", SecretAccessKey: "SECRET"}})
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKID" || creds.SecretAccessKey != "SECRET" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	if _, err := NewProviderAdapter(legacyProvider{}).Retrieve(context.Background()); err == nil {
+		t.Fatal("Expected error when the legacy provider returns no credentials")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := provider.Retrieve(ctx); err != context.Canceled {
+		t.Fatalf("Expected cancelled context to be reported, got %v", err)
+	}
+}
+
+func TestProviderAdapterKeepsProviders(t *testing.T) {
+	creds := &Credentials{AccessKeyId: "AKID"}
+	if NewProviderAdapter(creds) != Provider(creds) {
+		t.Fatal("Expected implementations of Provider to be returned as they are")
+	}
+}
+
+func TestConstructorsImplementBothInterfaces(t *testing.T) {
+	var legacy CredentialsProvider = NewIamUserCredentials("AKID", "SECRET")
+	if creds := legacy.GetCredentials(); creds.AccessKeyId != "AKID" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	refreshing, err := NewRefreshingCredentials(func(ctx context.Context) (Credentials, error) {
+		return Credentials{AccessKeyId: "AKID", Expiration: time.Now().Add(time.Hour)}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refreshing.Close()
+	legacy = refreshing
+	var provider RefreshingProvider = refreshing
+	if creds := legacy.GetCredentials(); creds.AccessKeyId != retrieve(t, provider).AccessKeyId {
+		t.Fatalf("Expected GetCredentials and Retrieve to return the same credentials, got %+v", creds)
+	}
+}
+
+func TestRetrieveExpiredCredentials(t *testing.T) {
+	fail := false
+	c := &ec2MetadataCredentials{
+		mu:    &sync.Mutex{},
+		ready: make(chan struct{}),
+		opts:  RefreshOptions{}.withDefaults(),
+		fetch: func(ctx context.Context, c *ec2MetadataCredentials) error {
+			if fail {
+				return errors.New("metadata unavailable")
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.AccessKeyId = "AKIDFRESH"
+			c.Expiration = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+			return nil
+		},
+	}
+	c.readyOnce.Do(func() { close(c.ready) })
+	c.AccessKeyId = "AKIDSTALE"
+	c.Expiration = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	// Expired credentials are refreshed on demand
+	creds := retrieve(t, c)
+	if creds.AccessKeyId != "AKIDFRESH" || !creds.Expiration.After(time.Now()) {
+		t.Fatalf("Expected refreshed credentials, got %+v", creds)
+	}
+
+	// and never returned if that fails
+	c.Expiration = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	fail = true
+	_, err := c.Retrieve(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "metadata unavailable") {
+		t.Fatalf("Expected error for expired credentials, got %v", err)
+	}
+}
+
+func TestRetrieveExpiredConcurrently(t *testing.T) {
+	var fetches int32
+	c := &ec2MetadataCredentials{
+		mu:    &sync.Mutex{},
+		ready: make(chan struct{}),
+		opts:  RefreshOptions{}.withDefaults(),
+		fetch: func(ctx context.Context, c *ec2MetadataCredentials) error {
+			atomic.AddInt32(&fetches, 1)
+			time.Sleep(50 * time.Millisecond)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.Expiration = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+			return nil
+		},
+	}
+	c.readyOnce.Do(func() { close(c.ready) })
+	c.Expiration = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retrieve(t, c)
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("Expected expired credentials to be fetched once, got %d fetches", n)
+	}
+}
+
+func TestRetrieveWhileFetchHangs(t *testing.T) {
+	started, hang := make(chan struct{}), make(chan struct{})
+	defer close(hang)
+	c := &ec2MetadataCredentials{
+		mu:    &sync.Mutex{},
+		ready: make(chan struct{}),
+		opts:  RefreshOptions{}.withDefaults(),
+		fetch: func(ctx context.Context, c *ec2MetadataCredentials) error {
+			close(started)
+			<-hang
+			return errors.New("metadata unavailable")
+		},
+	}
+	c.readyOnce.Do(func() { close(c.ready) })
+	c.Expiration = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	go c.Retrieve(context.Background())
+	<-started
+
+	// Waiting for the hanging fetch is given up with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := c.Retrieve(ctx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected error while the fetch hangs")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Retrieve to return when its context is done")
+	}
+}
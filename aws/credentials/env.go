@@ -0,0 +1,23 @@
+package credentials
+
+import (
+	"errors"
+	"os"
+)
+
+// Initialise credentials from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and (for temporary credentials) AWS_SESSION_TOKEN environment variables.
+// Returns an error if the key id or secret key are not set.
+func NewEnvCredentials() (*Credentials, error) {
+	keyId := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if keyId == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	return &Credentials{
+		AccessKeyId:     keyId,
+		SecretAccessKey: secretKey,
+		Token:           os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
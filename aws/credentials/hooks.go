@@ -0,0 +1,101 @@
+package credentials
+
+import (
+	"github.com/soundcloud/sc-gaws/stats"
+	"log"
+	"time"
+)
+
+const (
+	// Names of the metrics emitted about refreshed credentials, in seconds
+	CredentialsAgeMetric        = "CredentialsAge"
+	CredentialsTimeToLiveMetric = "CredentialsTimeToLive"
+
+	defaultMetricsInterval = 60 * time.Second
+)
+
+// Hooks is notified about refreshes of temporary credentials and about
+// providers of a chain that are not available, e.g. to alert on failures
+// before the credentials in use expire. Methods are called synchronously and
+// should return quickly.
+//
+// Embed NopHooks to implement only some of them.
+type Hooks interface {
+	// Called after fresh credentials were fetched
+	RefreshSucceeded(creds Credentials)
+
+	// Called after fetching credentials failed, with the number of
+	// consecutive failures so far
+	RefreshFailed(err error, failures int)
+
+	// Called once when cached credentials expired without being replaced
+	CredentialsExpired(expiration time.Time)
+
+	// Called when the provider at index of a chain is not available and the
+	// next one is tried
+	ChainFallback(index int, err error)
+}
+
+// NopHooks implements Hooks, ignoring all notifications
+type NopHooks struct{}
+
+func (NopHooks) RefreshSucceeded(creds Credentials)      {}
+func (NopHooks) RefreshFailed(err error, failures int)   {}
+func (NopHooks) CredentialsExpired(expiration time.Time) {}
+func (NopHooks) ChainFallback(index int, err error)      {}
+
+// Metrics about the current credentials of c: how long ago they were
+// fetched and how long until they expire
+func (c *ec2MetadataCredentials) metrics(now time.Time) []stats.Metric {
+	c.mu.Lock()
+	fetched := c.fetched
+	c.mu.Unlock()
+	if fetched.IsZero() {
+		return nil
+	}
+
+	metrics := []stats.Metric{
+		{Name: CredentialsAgeMetric, Value: float32(now.Sub(fetched).Seconds()), Unit: "Seconds", Timestamp: now},
+	}
+	if creds := c.current(); !creds.Expiration.IsZero() {
+		ttl := creds.Expiration.Sub(now)
+		if ttl < 0 {
+			ttl = 0
+		}
+		metrics = append(metrics, stats.Metric{Name: CredentialsTimeToLiveMetric, Value: float32(ttl.Seconds()), Unit: "Seconds", Timestamp: now})
+	}
+	return metrics
+}
+
+// Send metrics about the current credentials to RefreshOptions.Metrics.
+// Metrics are dropped rather than waiting for a slow consumer, which would
+// hold up refreshing the credentials.
+func (c *ec2MetadataCredentials) emitMetrics() {
+	for _, m := range c.metrics(time.Now()) {
+		select {
+		case c.opts.Metrics <- m:
+		default:
+			log.Printf("Dropped metric %s, metrics channel is full", m.Name)
+		}
+	}
+}
+
+// Notify hooks once if the cached credentials expired
+func (c *ec2MetadataCredentials) checkExpired() {
+	c.mu.Lock()
+	expiration := c.Expiration
+	reported := c.expiredReported
+	c.mu.Unlock()
+	if expiration == "" || expiration == reported {
+		return
+	}
+
+	creds := c.current()
+	if time.Now().Before(creds.Expiration) {
+		return
+	}
+	c.mu.Lock()
+	c.expiredReported = expiration
+	c.mu.Unlock()
+	c.opts.Hooks.CredentialsExpired(creds.Expiration)
+}
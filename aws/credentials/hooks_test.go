@@ -0,0 +1,147 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"github.com/soundcloud/sc-gaws/stats"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recordingHooks struct {
+	mu        sync.Mutex
+	succeeded []Credentials
+	failures  []int
+	expired   []time.Time
+	fallbacks []int
+}
+
+func (h *recordingHooks) RefreshSucceeded(creds Credentials) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.succeeded = append(h.succeeded, creds)
+}
+
+func (h *recordingHooks) RefreshFailed(err error, failures int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = append(h.failures, failures)
+}
+
+func (h *recordingHooks) CredentialsExpired(expiration time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expired = append(h.expired, expiration)
+}
+
+func (h *recordingHooks) ChainFallback(index int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fallbacks = append(h.fallbacks, index)
+}
+
+func TestRefreshHooks(t *testing.T) {
+	fail := false
+	var mu sync.Mutex
+	fetch := func(ctx context.Context) (Credentials, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			return Credentials{}, errors.New("fetch failed")
+		}
+		return Credentials{AccessKeyId: "AKID", Expiration: time.Now().Add(-time.Minute)}, nil
+	}
+
+	hooks := &recordingHooks{}
+	provider, err := NewRefreshingCredentialsWithOptions(fetch, RefreshOptions{Hooks: hooks, MinRetryDelay: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.Close()
+
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, err := provider.Retrieve(context.Background()); err == nil {
+			t.Fatal("Expected error retrieving expired credentials")
+		}
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	if len(hooks.succeeded) != 1 || hooks.succeeded[0].AccessKeyId != "AKID" {
+		t.Fatalf("Expected one successful refresh, got %+v", hooks.succeeded)
+	}
+	if len(hooks.failures) != 2 || hooks.failures[0] != 1 || hooks.failures[1] != 2 {
+		t.Fatalf("Expected two consecutive failures, got %v", hooks.failures)
+	}
+	if len(hooks.expired) != 1 {
+		t.Fatalf("Expected expiry to be reported once, got %v", hooks.expired)
+	}
+}
+
+func TestChainFallbackHook(t *testing.T) {
+	hooks := &recordingHooks{}
+	unavailable := func() (Provider, error) { return nil, errors.New("unavailable") }
+	static := func() (Provider, error) { return NewIamUserCredentials("AKID", "SECRET"), nil }
+
+	if _, err := NewChainWithHooks(hooks, unavailable, unavailable, static); err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks.fallbacks) != 2 || hooks.fallbacks[0] != 0 || hooks.fallbacks[1] != 1 {
+		t.Fatalf("Expected fallback from the first two providers, got %v", hooks.fallbacks)
+	}
+}
+
+func TestCredentialsMetrics(t *testing.T) {
+	metrics := make(chan stats.Metric, 10)
+	fetch := func(ctx context.Context) (Credentials, error) {
+		return Credentials{AccessKeyId: "AKID", Expiration: time.Now().Add(time.Hour)}, nil
+	}
+	provider, err := NewRefreshingCredentialsWithOptions(fetch, RefreshOptions{Metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	received := map[string]stats.Metric{}
+	for len(received) < 2 {
+		select {
+		case m := <-metrics:
+			received[m.Name] = m
+		case <-time.After(time.Second):
+			t.Fatalf("Expected metrics to be emitted, got %+v", received)
+		}
+	}
+
+	if age := received[CredentialsAgeMetric]; age.Unit != "Seconds" || age.Value < 0 || age.Value > 1 {
+		t.Fatalf("Unexpected age metric: %+v", age)
+	}
+	if ttl := received[CredentialsTimeToLiveMetric]; ttl.Unit != "Seconds" || ttl.Value < 3590 || ttl.Value > 3600 {
+		t.Fatalf("Unexpected time to live metric: %+v", ttl)
+	}
+}
+
+func TestMetricsDoNotBlockRefresh(t *testing.T) {
+	var fetches int32
+	signal := newRefreshSignal()
+	// Nobody reads the metrics, which used to block the refresher before the
+	// first refresh
+	provider, err := NewRefreshingCredentialsWithOptions(countingFetch(&fetches, shortLifetime), RefreshOptions{
+		Hooks:           signal,
+		Metrics:         make(chan stats.Metric),
+		MetricsInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signal.wait(t)
+	provider.Close()
+
+	if n := atomic.LoadInt32(&fetches); n < 2 {
+		t.Fatalf("Expected credentials to be refreshed despite unread metrics, got %d fetches", n)
+	}
+}
@@ -0,0 +1,42 @@
+package credentials
+
+import (
+	"github.com/soundcloud/sc-gaws/aws/ec2metadata"
+	"time"
+)
+
+// MetadataOptions configures how the EC2 Metadata API is queried.
+type MetadataOptions struct {
+	// Client to query the EC2 Metadata API with, e.g. to share it with code
+	// looking up the identity of the instance. If set, Endpoint, TokenTTL and
+	// AllowIMDSv1Fallback are ignored.
+	Client *ec2metadata.Client
+
+	// Base URL of the EC2 Metadata API. Defaults to the
+	// AWS_EC2_METADATA_SERVICE_ENDPOINT environment variable, or
+	// http://169.254.169.254 if not set.
+	Endpoint string
+
+	// Lifetime requested for IMDSv2 session tokens, between 1 second and
+	// 6 hours. Defaults to 6 hours. Values outside that range are clamped to
+	// it.
+	TokenTTL time.Duration
+
+	// Use plain IMDSv1 requests if no session token can be obtained. Off by
+	// default, as instances may be configured to reject them.
+	AllowIMDSv1Fallback bool
+
+	// How credentials fetched from the EC2 Metadata API are refreshed
+	Refresh RefreshOptions
+}
+
+func newMetadataClient(opts MetadataOptions) *ec2metadata.Client {
+	if opts.Client != nil {
+		return opts.Client
+	}
+	return ec2metadata.NewClient(ec2metadata.Options{
+		Endpoint:            opts.Endpoint,
+		TokenTTL:            opts.TokenTTL,
+		AllowIMDSv1Fallback: opts.AllowIMDSv1Fallback,
+	})
+}
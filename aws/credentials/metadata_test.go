@@ -0,0 +1,100 @@
+package credentials
+
+import (
+	"context"
+	"github.com/soundcloud/sc-gaws/aws/credentials/metadatatest"
+	"github.com/soundcloud/sc-gaws/aws/ec2metadata"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMetadataClient(server *metadatatest.Server, opts MetadataOptions) *ec2metadata.Client {
+	opts.Endpoint = server.URL
+	return newMetadataClient(opts)
+}
+
+func TestFetchRoleCredentialsIMDSv2(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+	c := newTestMetadataClient(server, MetadataOptions{TokenTTL: time.Minute})
+
+	creds := &ec2MetadataCredentials{mu: &sync.Mutex{}, metadata: c}
+	for i := 0; i < 2; i++ {
+		if err := fetchRoleCredentials(context.Background(), "test-role", creds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := server.Credentials()
+	if creds.AccessKeyId != expected.AccessKeyId || creds.Token != expected.Token {
+		t.Fatalf("Unexpected credentials: %+v", creds.GetCredentials())
+	}
+	if n := server.TokenRequests(); n != 1 {
+		t.Fatalf("Expected session token to be reused, %d tokens were requested", n)
+	}
+	if ttl := server.LastTokenTTL(); ttl != time.Minute {
+		t.Fatalf("Expected token TTL of 60 seconds, got %s", ttl)
+	}
+}
+
+func TestFetchRoleCredentialsIMDSv1Fallback(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+	server.SetIMDSv1(true)
+	server.SetIMDSv2(false)
+
+	creds := &ec2MetadataCredentials{mu: &sync.Mutex{}, metadata: newTestMetadataClient(server, MetadataOptions{})}
+	if err := fetchRoleCredentials(context.Background(), "test-role", creds); err == nil {
+		t.Fatal("Expected error without IMDSv1 fallback")
+	}
+
+	creds.metadata = newTestMetadataClient(server, MetadataOptions{AllowIMDSv1Fallback: true})
+	if err := fetchRoleCredentials(context.Background(), "test-role", creds); err != nil {
+		t.Fatalf("Expected IMDSv1 fallback to succeed, got %s", err)
+	}
+}
+
+func TestFetchRoleCredentialsFailure(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+
+	creds := &ec2MetadataCredentials{mu: &sync.Mutex{}, metadata: newTestMetadataClient(server, MetadataOptions{})}
+	if err := fetchRoleCredentials(context.Background(), "test-role", creds); err != nil {
+		t.Fatal(err)
+	}
+	expected := creds.current()
+
+	path := metadatatest.CredentialsPath + "test-role"
+	for _, body := range []string{
+		`{"Code":"AssumeRoleUnauthorizedAccess","Message":"EC2 cannot assume the role"}`,
+		`{"Code":"Success","AccessKeyId":"AKID","Expiration":"2017-03-01T12:00:00Z"}`,
+		`{"Code":"Success","AccessKeyId":"AKID","SecretAccessKey":"SECRET","Expiration":"soon"}`,
+	} {
+		server.SetMetadata(path, body)
+		if err := fetchRoleCredentials(context.Background(), "test-role", creds); err == nil {
+			t.Errorf("Expected error for %s", body)
+		}
+		if c := creds.current(); c != expected {
+			t.Fatalf("Expected credentials to be kept for %s, got %+v", body, c)
+		}
+	}
+}
+
+func TestSharedMetadataClient(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+	client := ec2metadata.NewClient(ec2metadata.Options{Endpoint: server.URL})
+
+	provider, err := NewDiscoveredIamRoleCredentialsWithOptions(MetadataOptions{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	if _, err := client.Get(context.Background(), credentialsPath); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.TokenRequests(); n != 1 {
+		t.Fatalf("Expected session token to be shared, %d tokens were requested", n)
+	}
+}
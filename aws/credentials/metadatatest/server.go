@@ -0,0 +1,312 @@
+// Package metadatatest provides an in-process fake of the EC2 Metadata API
+// for testing code that uses role credentials without running on EC2.
+//
+// The fake hands out IMDSv2 session tokens that expire after their requested
+// TTL, lists the role attached to the instance profile and serves rotating
+// credentials for it. Any other metadata can be set explicitly. Failures can
+// be injected for any path.
+//
+//	server := metadatatest.NewServer()
+//	defer server.Close()
+//	provider, err := credentials.NewIamRoleCredentialsWithOptions("test-role",
+//	    credentials.MetadataOptions{Endpoint: server.URL})
+package metadatatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenPath       = "/latest/api/token"
+	CredentialsPath = "/latest/meta-data/iam/security-credentials/"
+
+	tokenHeader    = "X-aws-ec2-metadata-token"
+	tokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	maxTokenTTL    = 6 * time.Hour
+
+	DefaultRole                = "test-role"
+	DefaultCredentialsLifetime = 6 * time.Hour
+)
+
+// Credentials served for the role attached to the instance profile
+type Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+type injectedError struct {
+	path   string
+	status int
+	times  int
+}
+
+// Server is a fake EC2 Metadata API listening on a local address. It is safe
+// to reconfigure while requests are served.
+type Server struct {
+	// Base URL of the fake, e.g. http://127.0.0.1:45678
+	URL string
+
+	server *httptest.Server
+
+	mu            sync.Mutex
+	v1            bool
+	v2            bool
+	role          string
+	lifetime      time.Duration
+	generation    int
+	credentials   Credentials
+	tokens        map[string]time.Time
+	tokenRequests int
+	lastTokenTTL  time.Duration
+	requests      map[string]int
+	errors        []*injectedError
+	metadata      map[string]string
+}
+
+// NewServer starts a fake that only accepts IMDSv2 requests and serves
+// credentials for DefaultRole, expiring after DefaultCredentialsLifetime.
+func NewServer() *Server {
+	s := &Server{
+		v2:       true,
+		role:     DefaultRole,
+		lifetime: DefaultCredentialsLifetime,
+		tokens:   make(map[string]time.Time),
+		requests: make(map[string]int),
+		metadata: make(map[string]string),
+	}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+// Stop the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Accept plain IMDSv1 requests without a session token. Off by default.
+func (s *Server) SetIMDSv1(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.v1 = enabled
+}
+
+// Hand out IMDSv2 session tokens. On by default.
+func (s *Server) SetIMDSv2(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.v2 = enabled
+}
+
+// Attach role to the instance profile, replacing the credentials served. An
+// empty role detaches it.
+func (s *Server) SetRole(role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.role = role
+	s.rotate()
+}
+
+// Serve credentials that expire after lifetime from now on
+func (s *Server) SetCredentialsLifetime(lifetime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetime = lifetime
+	s.rotate()
+}
+
+// Replace the credentials served with new ones, as EC2 does before they
+// expire. Credentials are also replaced once they expired.
+func (s *Server) Rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate()
+}
+
+// Reject all session tokens handed out so far, as happens when the metadata
+// service restarts
+func (s *Server) InvalidateTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]time.Time)
+}
+
+// Fail the next times requests for path, or paths below it, with status.
+// Requests for all paths fail if path is empty. Times less than 1 fails
+// requests until Reset.
+func (s *Server) InjectError(path string, status int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, &injectedError{path, status, times})
+}
+
+// Serve value for path, e.g. /latest/meta-data/instance-id. Listings of
+// nested paths need to be set explicitly.
+func (s *Server) SetMetadata(path string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata[path] = value
+}
+
+// Stop serving path set with SetMetadata
+func (s *Server) DeleteMetadata(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.metadata, path)
+}
+
+// Remove all injected errors
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = nil
+}
+
+// Credentials currently served for the role
+func (s *Server) Credentials() Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current()
+}
+
+// Number of session tokens handed out
+func (s *Server) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenRequests
+}
+
+// TTL requested for the last session token
+func (s *Server) LastTokenTTL() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastTokenTTL
+}
+
+// Number of requests for path, including failed ones
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) rotate() {
+	s.generation++
+	s.credentials = Credentials{
+		AccessKeyId:     fmt.Sprintf("ASIAMETADATATEST%04d", s.generation),
+		SecretAccessKey: fmt.Sprintf("secret-%d", s.generation),
+		Token:           fmt.Sprintf("session-token-%d", s.generation),
+		Expiration:      time.Now().Add(s.lifetime).UTC().Truncate(time.Second),
+	}
+}
+
+func (s *Server) current() Credentials {
+	if s.generation == 0 || !time.Now().Before(s.credentials.Expiration) {
+		s.rotate()
+	}
+	return s.credentials
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[r.URL.Path]++
+	if status := s.injectedError(r.URL.Path); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if r.URL.Path == TokenPath {
+		s.serveToken(w, r)
+		return
+	}
+
+	token := r.Header.Get(tokenHeader)
+	if token == "" && !s.v1 {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	if token != "" {
+		expiry, ok := s.tokens[token]
+		if !ok || !time.Now().Before(expiry) {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	value, ok := s.metadata[r.URL.Path]
+	switch {
+	case ok:
+		fmt.Fprint(w, value)
+	case r.URL.Path == CredentialsPath && s.role != "":
+		fmt.Fprintln(w, s.role)
+	case r.URL.Path == CredentialsPath+s.role && s.role != "":
+		s.serveCredentials(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if !s.v2 {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	if r.Method != "PUT" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	seconds, err := strconv.Atoi(r.Header.Get(tokenTTLHeader))
+	ttl := time.Duration(seconds) * time.Second
+	if err != nil || ttl < time.Second || ttl > maxTokenTTL {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	s.tokenRequests++
+	s.lastTokenTTL = ttl
+	token := fmt.Sprintf("metadatatest-token-%d", s.tokenRequests)
+	s.tokens[token] = time.Now().Add(ttl)
+	w.Header().Set(tokenTTLHeader, strconv.Itoa(seconds))
+	fmt.Fprint(w, token)
+}
+
+func (s *Server) serveCredentials(w http.ResponseWriter) {
+	creds := s.current()
+	json.NewEncoder(w).Encode(map[string]string{
+		"Code":            "Success",
+		"LastUpdated":     time.Now().UTC().Format(time.RFC3339),
+		"Type":            "AWS-HMAC",
+		"AccessKeyId":     creds.AccessKeyId,
+		"SecretAccessKey": creds.SecretAccessKey,
+		"Token":           creds.Token,
+		"Expiration":      creds.Expiration.Format(time.RFC3339),
+	})
+}
+
+// Status of the first injected error matching path, or 0 if none does
+func (s *Server) injectedError(path string) int {
+	for i, e := range s.errors {
+		if e.path != "" && e.path != path && !strings.HasPrefix(path, strings.TrimSuffix(e.path, "/")+"/") {
+			continue
+		}
+		if e.times > 0 {
+			e.times--
+			if e.times == 0 {
+				s.errors = append(s.errors[:i], s.errors[i+1:]...)
+			}
+		}
+		return e.status
+	}
+	return 0
+}
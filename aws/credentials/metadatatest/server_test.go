@@ -0,0 +1,139 @@
+package metadatatest_test
+
+import (
+	"context"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"github.com/soundcloud/sc-gaws/aws/credentials/metadatatest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRoleCredentials(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+
+	provider, err := credentials.NewDiscoveredIamRoleCredentialsWithOptions(credentials.MetadataOptions{Endpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	creds, err := provider.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := server.Credentials()
+	if creds.AccessKeyId != expected.AccessKeyId || creds.SecretAccessKey != expected.SecretAccessKey ||
+		creds.Token != expected.Token || !creds.Expiration.Equal(expected.Expiration) {
+		t.Fatalf("Expected %+v, got %+v", expected, creds)
+	}
+}
+
+// Hooks passing on refreshed credentials
+type refreshSignal struct {
+	credentials.NopHooks
+	refreshed chan credentials.Credentials
+}
+
+func (s refreshSignal) RefreshSucceeded(creds credentials.Credentials) {
+	select {
+	case s.refreshed <- creds:
+	default:
+	}
+}
+
+func TestRotation(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+	server.SetCredentialsLifetime(2 * time.Second)
+
+	signal := refreshSignal{refreshed: make(chan credentials.Credentials)}
+	provider, err := credentials.NewIamRoleCredentialsWithOptions(metadatatest.DefaultRole, credentials.MetadataOptions{
+		Endpoint: server.URL,
+		Refresh:  credentials.RefreshOptions{Hooks: signal},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	first, _ := provider.Retrieve(context.Background())
+
+	// Credentials are refreshed before they expire
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case creds := <-signal.refreshed:
+			if creds.AccessKeyId == first.AccessKeyId {
+				continue
+			}
+			second, err := provider.Retrieve(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second.AccessKeyId == first.AccessKeyId {
+				t.Fatalf("Expected rotated credentials, got %s twice", first.AccessKeyId)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Expected credentials to be rotated, still got %s", first.AccessKeyId)
+		}
+	}
+}
+
+func TestInjectedErrors(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+
+	server.InjectError(metadatatest.CredentialsPath, http.StatusInternalServerError, 1)
+	opts := credentials.MetadataOptions{Endpoint: server.URL}
+	if _, err := credentials.NewIamRoleCredentialsWithOptions(metadatatest.DefaultRole, opts); err == nil {
+		t.Fatal("Expected injected error")
+	}
+
+	provider, err := credentials.NewIamRoleCredentialsWithOptions(metadatatest.DefaultRole, opts)
+	if err != nil {
+		t.Fatalf("Expected injected error to be used up, got %s", err)
+	}
+	provider.Close()
+
+	server.InjectError("", http.StatusServiceUnavailable, 0)
+	if _, err := credentials.NewIamRoleCredentialsWithOptions(metadatatest.DefaultRole, opts); err == nil {
+		t.Fatal("Expected injected error")
+	}
+	server.Reset()
+
+	// The last attempt already failed to get a session token
+	if n := server.Requests(metadatatest.CredentialsPath + metadatatest.DefaultRole); n != 2 {
+		t.Fatalf("Expected 2 credentials requests, got %d", n)
+	}
+	if n := server.Requests(metadatatest.TokenPath); n != 3 {
+		t.Fatalf("Expected 3 token requests, got %d", n)
+	}
+}
+
+func TestSessionTokens(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+
+	// Plain IMDSv1 requests are rejected by default
+	res, err := http.Get(server.URL + metadatatest.CredentialsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected IMDSv1 request to be rejected, got status %d", res.StatusCode)
+	}
+
+	req, _ := http.NewRequest("PUT", server.URL+metadatatest.TokenPath, nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || server.LastTokenTTL() != time.Minute {
+		t.Fatalf("Expected token with a TTL of 60s, got status %d and TTL %s", res.StatusCode, server.LastTokenTTL())
+	}
+}
@@ -0,0 +1,117 @@
+// Implements the credential_process convention: an external command prints
+// credentials as JSON on its standard output, e.g.
+//
+//  {
+//    "Version": 1,
+//    "AccessKeyId": "an AWS access key",
+//    "SecretAccessKey": "your AWS secret access key",
+//    "SessionToken": "the AWS session token for temporary credentials",
+//    "Expiration": "RFC3339 timestamp for when the credentials expire"
+//  }
+//
+// The command is run again to refresh the credentials before they expire.
+// Credentials without an Expiration are used for as long as the process runs.
+//
+// More info: http://docs.aws.amazon.com/cli/latest/userguide/cli-configure-sourcing-external.html
+
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	processCredentialsVersion = 1
+	defaultProcessTimeout     = 1 * time.Minute
+)
+
+// ProcessOptions configures how credentials are obtained from a credential
+// process.
+type ProcessOptions struct {
+	// Time the command may take before it is killed and the fetch fails.
+	// Defaults to 1 minute.
+	Timeout time.Duration
+
+	// How the credentials are refreshed
+	Refresh RefreshOptions
+}
+
+type processOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+}
+
+// Initialise credentials from the output of command, which is run through
+// the shell. Returns an error if the command fails or its output is invalid.
+func NewProcessCredentials(command string) (*RefreshingCredentials, error) {
+	return NewProcessCredentialsWithOptions(command, ProcessOptions{})
+}
+
+// Initialise credentials from the output of command, running and refreshing
+// it as configured by opts.
+func NewProcessCredentialsWithOptions(command string, opts ProcessOptions) (*RefreshingCredentials, error) {
+	if strings.TrimSpace(command) == "" {
+		return nil, errors.New("No credential process command given")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultProcessTimeout
+	}
+	return NewRefreshingCredentialsWithOptions(func(ctx context.Context) (Credentials, error) {
+		return runCredentialProcess(ctx, command, opts.Timeout)
+	}, opts.Refresh)
+}
+
+// Run command, killing it if it takes longer than timeout
+func runCredentialProcess(ctx context.Context, command string, timeout time.Duration) (Credentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Stop waiting for output once the shell is killed, even if commands it
+	// started still hold on to it
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		return Credentials{}, fmt.Errorf("Credential process failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out processOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Credentials{}, fmt.Errorf("Cannot parse credential process output: %v", err)
+	}
+	if out.Version != processCredentialsVersion {
+		return Credentials{}, fmt.Errorf("Unsupported credential process output version %d", out.Version)
+	}
+	if out.AccessKeyId == "" || out.SecretAccessKey == "" {
+		return Credentials{}, errors.New("Credential process output is missing AccessKeyId or SecretAccessKey")
+	}
+
+	creds := Credentials{
+		AccessKeyId:     out.AccessKeyId,
+		SecretAccessKey: out.SecretAccessKey,
+		Token:           out.SessionToken,
+	}
+	if out.Expiration != nil {
+		creds.Expiration = *out.Expiration
+	}
+	return creds, nil
+}
@@ -0,0 +1,120 @@
+package credentials
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Not a real test: prints credentials expiring after CREDENTIAL_PROCESS_TTL
+// when run as a credential process by the tests below.
+func TestHelperCredentialProcess(t *testing.T) {
+	ttl := os.Getenv("CREDENTIAL_PROCESS_TTL")
+	if ttl == "" {
+		return
+	}
+	d, _ := time.ParseDuration(ttl)
+	fmt.Printf(`{"Version": 1, "AccessKeyId": "AKID%d", "SecretAccessKey": "SECRET", "SessionToken": "TOKEN", "Expiration": "%s"}`,
+		time.Now().UnixNano(), time.Now().Add(d).UTC().Format(time.RFC3339Nano))
+	os.Exit(0)
+}
+
+func helperProcessCommand(ttl time.Duration) string {
+	return fmt.Sprintf("CREDENTIAL_PROCESS_TTL=%s %s -test.run=TestHelperCredentialProcess", ttl, os.Args[0])
+}
+
+func TestProcessCredentials(t *testing.T) {
+	provider, err := NewProcessCredentials(`echo '{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET"}'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKID" || creds.SecretAccessKey != "SECRET" || creds.Token != "" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+}
+
+func TestProcessCredentialsRefresh(t *testing.T) {
+	// Long enough for the credentials to outlive starting the process
+	signal := newRefreshSignal()
+	provider, err := NewProcessCredentialsWithOptions(helperProcessCommand(4*shortLifetime), ProcessOptions{Refresh: RefreshOptions{Hooks: signal}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	first := retrieve(t, provider)
+	if !strings.HasPrefix(first.AccessKeyId, "AKID") || first.Token != "TOKEN" {
+		t.Fatalf("Unexpected credentials: %+v", first)
+	}
+
+	if signal.wait(t).AccessKeyId == first.AccessKeyId {
+		t.Fatal("Expected credential process to be run again before the credentials expire")
+	}
+}
+
+func TestProcessCredentialsErrors(t *testing.T) {
+	commands := map[string]string{
+		"failing command": "echo 'no credentials for you' >&2; exit 1",
+		"invalid output":  "echo not-json",
+		"wrong version":   `echo '{"Version": 2, "AccessKeyId": "AKID", "SecretAccessKey": "SECRET"}'`,
+		"missing keys":    `echo '{"Version": 1, "AccessKeyId": "AKID"}'`,
+		"empty command":   " ",
+	}
+	for name, command := range commands {
+		if _, err := NewProcessCredentials(command); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	_, err := NewProcessCredentials("echo 'no credentials for you' >&2; exit 1")
+	if !strings.Contains(err.Error(), "no credentials for you") {
+		t.Fatalf("Expected error to include the command's stderr, got %s", err)
+	}
+}
+
+func TestProcessCredentialsTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := NewProcessCredentialsWithOptions("sleep 10", ProcessOptions{Timeout: 100 * time.Millisecond})
+	if err == nil {
+		t.Fatal("Expected error when the command times out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected command to be killed after the timeout, took %s", elapsed)
+	}
+}
+
+func TestSharedProfileCredentialProcess(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	ioutil.WriteFile(config, []byte(`
+[profile tooling]
+credential_process = echo '{"Version": 1, "AccessKeyId": "AKIDPROCESS", "SecretAccessKey": "SECRET"}'
+`), 0600)
+	setenv(t, map[string]string{
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials"),
+		"AWS_CONFIG_FILE":             config,
+	})
+
+	provider, err := NewSharedProcessCredentials("tooling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKIDPROCESS" {
+		t.Fatalf("Expected credentials from credential_process, got %+v", creds)
+	}
+
+	// Picked by the default chain, but not for static keys
+	chained, err := newSharedProfileCredentials("tooling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := retrieve(t, chained); creds.AccessKeyId != "AKIDPROCESS" {
+		t.Fatalf("Expected credentials from credential_process, got %+v", creds)
+	}
+	if _, err := NewSharedCredentials("tooling"); err == nil {
+		t.Fatal("Expected error for profile without static keys")
+	}
+}
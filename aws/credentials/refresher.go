@@ -3,45 +3,297 @@
 //
 // A long running goroutine queries the EC2 Metadata via the web API, and
 // extracts the credentials. The goroutine ensures that a refresh of
-// credentials is initiated before the current credentails expire.
+// credentials is initiated before the current credentails expire. It runs
+// until the provider is closed or the context it was started with is done.
 //
 // More info: http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/UsingIAM.html#UsingIAMrolesWithAmazonEC2Instances
 
 package credentials
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"github.com/soundcloud/sc-gaws/aws/ec2metadata"
+	"github.com/soundcloud/sc-gaws/stats"
 	"log"
-	"net/http"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	// Prefix for the URL to hit the EC2 Metadata API with
-	credentialsEndpoint    = "http://169.254.169.254/latest/meta-data/iam/security-credentials/"
+	// Prefix for the EC2 Metadata API path to fetch role credentials from
+	credentialsPath        = "/latest/meta-data/iam/security-credentials/"
 	defaultRefreshDuration = 5 * time.Second
+	defaultRefreshWindow   = 5 * time.Minute
+	defaultRefreshJitter   = 1 * time.Minute
+	defaultMinRetryDelay   = 1 * time.Second
+	defaultMaxRetryDelay   = 1 * time.Minute
 )
 
-// Refresh IAM Role credentials for EC2 Metadata API before they expire
-func credentialsRefresher(c *ec2MetadataCredentials, role string) {
-	duration := calculateRefreshDuration(c.Expiration)
+// FetchFunc fetches temporary credentials, setting the time they expire. A
+// zero expiration time means the credentials never expire.
+type FetchFunc func(ctx context.Context) (Credentials, error)
 
+// RefreshOptions configures how temporary credentials are refreshed in the
+// background.
+type RefreshOptions struct {
+	// Background refreshing stops when Context is done. Defaults to a context
+	// that is only done once the provider is closed.
+	Context context.Context
+
+	// Return from the constructor without waiting for the first fetch, which
+	// is then retried in the background until it succeeds. Use Wait to block
+	// until credentials are available.
+	StartAsync bool
+
+	// Refresh credentials this long before they expire, at most halfway
+	// through their remaining lifetime. Defaults to 5 minutes.
+	Window time.Duration
+
+	// Refresh up to this much earlier still, chosen at random, so that
+	// instances started together do not all refresh at once. Defaults to
+	// 1 minute.
+	Jitter time.Duration
+
+	// Delay before retrying a failed refresh, doubling with every further
+	// failure up to MaxRetryDelay. Default to 1 second and 1 minute.
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+
+	// Cached credentials are served while at least ExpiryMargin is left
+	// before they expire, even if refreshing them keeps failing in the
+	// background. After that they are fetched on demand, returning an error
+	// if that fails too. Defaults to 0, serving them right up to expiry.
+	ExpiryMargin time.Duration
+
+	// Notified about refreshes. Defaults to NopHooks.
+	Hooks Hooks
+
+	// If set, the age of the credentials and the time until they expire are
+	// sent as CredentialsAgeMetric and CredentialsTimeToLiveMetric every
+	// MetricsInterval, which defaults to 60 seconds, and after every refresh.
+	// Metrics the channel is not ready to receive are dropped, so that a slow
+	// consumer cannot hold up refreshing, so it should be buffered.
+	Metrics         chan<- stats.Metric
+	MetricsInterval time.Duration
+}
+
+func (o RefreshOptions) withDefaults() RefreshOptions {
+	if o.Context == nil {
+		o.Context = context.Background()
+	}
+	if o.Window <= 0 {
+		o.Window = defaultRefreshWindow
+	}
+	if o.Jitter <= 0 {
+		o.Jitter = defaultRefreshJitter
+	}
+	if o.Hooks == nil {
+		o.Hooks = NopHooks{}
+	}
+	if o.MetricsInterval <= 0 {
+		o.MetricsInterval = defaultMetricsInterval
+	}
+	if o.MinRetryDelay <= 0 {
+		o.MinRetryDelay = defaultMinRetryDelay
+	}
+	if o.MaxRetryDelay < o.MinRetryDelay {
+		o.MaxRetryDelay = defaultMaxRetryDelay
+		if o.MaxRetryDelay < o.MinRetryDelay {
+			o.MaxRetryDelay = o.MinRetryDelay
+		}
+	}
+	return o
+}
+
+// Time to wait before refreshing credentials expiring at expiration
+func (o RefreshOptions) refreshDelay(expiration string) time.Duration {
+	remaining := calculateRefreshDuration(expiration)
+	window := o.Window
+	if o.Jitter > 0 {
+		window += time.Duration(rand.Int63n(int64(o.Jitter)))
+	}
+	if window > remaining/2 {
+		window = remaining / 2
+	}
+	return remaining - window
+}
+
+// Time to wait before retrying after failures consecutive failed refreshes,
+// backing off exponentially with jitter
+func (o RefreshOptions) retryDelay(failures int) time.Duration {
+	// Compare against the shifted maximum, as shifting the minimum could
+	// overflow after many failures
+	delay := o.MaxRetryDelay
+	if failures < 63 && o.MinRetryDelay < o.MaxRetryDelay>>uint(failures) {
+		delay = o.MinRetryDelay << uint(failures)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// RefreshingProvider is implemented by providers that refresh temporary
+// credentials in the background.
+type RefreshingProvider interface {
+	Provider
+
+	// Fetch fresh credentials immediately, rescheduling the next background
+	// refresh accordingly.
+	Refresh(ctx context.Context) error
+
+	// Block until credentials were fetched successfully once, or ctx is done.
+	Wait(ctx context.Context) error
+
+	// Stop refreshing in the background. Credentials fetched before can
+	// still be retrieved.
+	Close() error
+}
+
+// RefreshingCredentials are temporary credentials refreshed in the
+// background. They implement RefreshingProvider, as well as the deprecated
+// CredentialsProvider for code not migrated to Provider yet.
+type RefreshingCredentials struct {
+	creds *ec2MetadataCredentials
+}
+
+func (r *RefreshingCredentials) Retrieve(ctx context.Context) (Credentials, error) {
+	return r.creds.Retrieve(ctx)
+}
+
+func (r *RefreshingCredentials) GetCredentials() *Credentials {
+	return r.creds.GetCredentials()
+}
+
+func (r *RefreshingCredentials) Refresh(ctx context.Context) error {
+	return r.creds.Refresh(ctx)
+}
+
+func (r *RefreshingCredentials) Wait(ctx context.Context) error {
+	return r.creds.Wait(ctx)
+}
+
+func (r *RefreshingCredentials) Close() error {
+	return r.creds.Close()
+}
+
+// Initialise temporary credentials obtained by calling fetch, which is called
+// again to refresh them before they expire. Returns an error if the first
+// fetch fails.
+func NewRefreshingCredentials(fetch FetchFunc) (*RefreshingCredentials, error) {
+	return NewRefreshingCredentialsWithOptions(fetch, RefreshOptions{})
+}
+
+// Initialise temporary credentials obtained by calling fetch, refreshing them
+// as configured by opts.
+func NewRefreshingCredentialsWithOptions(fetch FetchFunc, opts RefreshOptions) (*RefreshingCredentials, error) {
+	return startRefresher(&ec2MetadataCredentials{fetch: func(ctx context.Context, c *ec2MetadataCredentials) error {
+		creds, err := fetch(ctx)
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.AccessKeyId = creds.AccessKeyId
+		c.SecretAccessKey = creds.SecretAccessKey
+		c.Token = creds.Token
+		// Keep fractional seconds, which parsing RFC3339 times accepts too
+		c.Expiration = ""
+		if !creds.Expiration.IsZero() {
+			c.Expiration = creds.Expiration.UTC().Format(time.RFC3339Nano)
+		}
+		return nil
+	}}, opts)
+}
+
+// Fetch the initial credentials for c, unless starting asynchronously, and
+// start refreshing them in the background as long as they expire.
+func startRefresher(c *ec2MetadataCredentials, opts RefreshOptions) (*RefreshingCredentials, error) {
+	opts = opts.withDefaults()
+	c.opts = opts
+	c.mu = &sync.Mutex{}
+	c.ready = make(chan struct{})
+	c.reschedule = make(chan struct{}, 1)
+	c.done = make(chan struct{})
+	c.ctx, c.cancel = context.WithCancel(opts.Context)
+
+	if !opts.StartAsync {
+		err := c.refresh(c.ctx)
+		if err != nil {
+			c.cancel()
+			return nil, err
+		}
+		if c.expiration() == "" {
+			close(c.done)
+			return &RefreshingCredentials{c}, nil
+		}
+	}
+
+	go credentialsRefresher(c)
+	return &RefreshingCredentials{c}, nil
+}
+
+// Refresh credentials before they expire, until c is closed or its context
+// is done
+func credentialsRefresher(c *ec2MetadataCredentials) {
+	defer close(c.done)
+
+	// Fetch right away if starting asynchronously
+	var delay time.Duration
+	if c.isReady() {
+		delay = c.opts.refreshDelay(c.expiration())
+	}
+
+	// Receiving from a nil channel blocks forever, disabling metrics
+	var tick <-chan time.Time
+	if c.opts.Metrics != nil {
+		ticker := time.NewTicker(c.opts.MetricsInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		c.emitMetrics()
+	}
+
+	failures := 0
+	log.Printf("Refreshing credentials in %s", delay)
+	timeout := time.NewTimer(delay)
+	defer timeout.Stop()
 	for {
-		log.Printf("Refreshing credentials in %s", duration)
-		timeout := time.After(duration - (1 * time.Second))
 		select {
-		case <-timeout:
-			err := fetchRoleCredentials(role, c)
+		case <-c.ctx.Done():
+			log.Printf("Stopped refreshing credentials: %s", c.ctx.Err())
+			return
+		case <-tick:
+			c.emitMetrics()
+			continue
+		case <-c.reschedule:
+			if !timeout.Stop() {
+				<-timeout.C
+			}
+			failures = 0
+			delay = c.opts.refreshDelay(c.expiration())
+		case <-timeout.C:
+			err := c.refresh(c.ctx)
 			if err != nil {
-				log.Printf("Error fetching role credentials. Retrying in %ds: %s", defaultRefreshDuration, err)
-				duration = defaultRefreshDuration
+				delay = c.opts.retryDelay(failures)
+				failures++
+				log.Printf("Error fetching credentials (%d failures). Retrying in %s: %s", failures, delay, err)
+				c.checkExpired()
+			} else if c.expiration() == "" {
+				// Credentials never expire, nothing left to refresh
+				return
 			} else {
-				duration = calculateRefreshDuration(c.Expiration)
+				failures = 0
+				delay = c.opts.refreshDelay(c.expiration())
 			}
 		}
+		if c.opts.Metrics != nil {
+			c.emitMetrics()
+		}
+		log.Printf("Refreshing credentials in %s", delay)
+		timeout.Reset(delay)
 	}
 }
 
@@ -60,29 +312,87 @@ func calculateRefreshDuration(expiration string) (duration time.Duration) {
 	return
 }
 
-// Fetch credentials for a role
-func fetchRoleCredentials(role string, creds *ec2MetadataCredentials) error {
+// Fetch credentials for the role of c, first looking up the role attached to
+// the instance profile if it was not configured.
+func refreshRoleCredentials(ctx context.Context, c *ec2MetadataCredentials) error {
+	if c.discoverRole {
+		role, err := discoverRole(ctx, c.metadata)
+		if err != nil {
+			return err
+		}
+		if c.role != "" && c.role != role {
+			log.Printf("Instance profile role changed from %s to %s", c.role, role)
+		}
+		c.role = role
+	}
+	return fetchRoleCredentials(ctx, c.role, c)
+}
+
+// Look up the name of the role attached to the instance profile. The
+// metadata service lists it on a line of its own.
+func discoverRole(ctx context.Context, metadata *ec2metadata.Client) (string, error) {
+	body, err := metadata.Get(ctx, credentialsPath)
+	if err != nil {
+		return "", err
+	}
+	roles := strings.Fields(string(body))
+	if len(roles) == 0 {
+		return "", errors.New("No IAM role attached to the instance profile")
+	}
+	return roles[0], nil
+}
 
-	url := credentialsEndpoint + role
-	log.Printf("Querying EC2 Metadata for credentials: %s", url)
-	resp, err := http.Get(url)
+// Fetch credentials for a role
+func fetchRoleCredentials(ctx context.Context, role string, creds *ec2MetadataCredentials) error {
 
+	path := credentialsPath + role
+	log.Printf("Querying EC2 Metadata for credentials: %s", path)
+	body, err := creds.metadata.Get(ctx, path)
 	if err != nil {
 		return err
 	}
+	return creds.update(body, true)
+}
 
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("EC2 Metadata returned status %s\n%s", resp.StatusCode, body))
-	}
+// Response of the EC2 Metadata API and the container credentials endpoint
+type roleCredentialsResponse struct {
+	Code            string
+	Message         string
+	LastUpdated     string
+	Type            string
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
 
-	creds.mu.Lock()
-	defer creds.mu.Unlock()
-	err = json.Unmarshal(body, creds)
-	if err != nil {
+// Replace the credentials of c with those in body, unless it reports a
+// failure or lacks any of them. The EC2 Metadata API always sets Code, the
+// container endpoint only on failures, so it is required if requireCode is
+// set.
+func (c *ec2MetadataCredentials) update(body []byte, requireCode bool) error {
+	var r roleCredentialsResponse
+	if err := json.Unmarshal(body, &r); err != nil {
 		return err
 	}
+	if r.Code != "Success" && (r.Code != "" || requireCode) {
+		return fmt.Errorf("Fetching credentials failed with code %s: %s", r.Code, r.Message)
+	}
+	if r.AccessKeyId == "" || r.SecretAccessKey == "" || r.Expiration == "" {
+		return errors.New("Incomplete credentials returned without AccessKeyId, SecretAccessKey or Expiration")
+	}
+	if _, err := time.Parse(time.RFC3339, r.Expiration); err != nil {
+		return fmt.Errorf("Invalid credentials expiration %s: %v", r.Expiration, err)
+	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Code = r.Code
+	c.LastUpdated = r.LastUpdated
+	c.Type = r.Type
+	c.AccessKeyId = r.AccessKeyId
+	c.SecretAccessKey = r.SecretAccessKey
+	c.Token = r.Token
+	c.Expiration = r.Expiration
 	return nil
 }
@@ -1,6 +1,12 @@
 package credentials
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws/credentials/metadatatest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -31,3 +37,329 @@ func TestFutureExpiryTime(t *testing.T) {
 		t.Fatalf("Expected duration with 1s of 10s, got %s", duration)
 	}
 }
+
+func TestDiscoverRole(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+	server.SetRole("first-role")
+	c := newTestMetadataClient(server, MetadataOptions{})
+
+	creds := &ec2MetadataCredentials{mu: &sync.Mutex{}, metadata: c, discoverRole: true}
+	if err := refreshRoleCredentials(context.Background(), creds); err != nil {
+		t.Fatal(err)
+	}
+	if creds.role != "first-role" || creds.AccessKeyId != server.Credentials().AccessKeyId {
+		t.Fatalf("Expected credentials for first-role, got %s: %+v", creds.role, creds.GetCredentials())
+	}
+
+	// Instance profile changed
+	server.SetRole("second-role")
+	if err := refreshRoleCredentials(context.Background(), creds); err != nil {
+		t.Fatal(err)
+	}
+	if creds.role != "second-role" {
+		t.Fatalf("Expected role change to be discovered, got %s", creds.role)
+	}
+}
+
+func TestDiscoverRoleWithoutInstanceProfile(t *testing.T) {
+	server := metadatatest.NewServer()
+	defer server.Close()
+	server.SetRole("")
+	c := newTestMetadataClient(server, MetadataOptions{})
+
+	if _, err := discoverRole(context.Background(), c); err == nil {
+		t.Fatal("Expected error when no role is attached to the instance profile")
+	}
+}
+
+func TestRefreshingCredentials(t *testing.T) {
+	fetches := 0
+	fetch := func(ctx context.Context) (Credentials, error) {
+		fetches++
+		if fetches > 1 {
+			return Credentials{}, errors.New("fetch failed")
+		}
+		return Credentials{AccessKeyId: "AKID", SecretAccessKey: "SECRET", Token: "TOKEN", Expiration: time.Now().Add(time.Hour)}, nil
+	}
+
+	provider, err := NewRefreshingCredentials(fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKID" || creds.Token != "TOKEN" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	if _, err := NewRefreshingCredentials(fetch); err == nil {
+		t.Fatal("Expected error when the first fetch fails")
+	}
+}
+
+// Fetches credentials expiring after lifetime, counting the fetches
+func countingFetch(fetches *int32, lifetime time.Duration) FetchFunc {
+	return func(ctx context.Context) (Credentials, error) {
+		n := atomic.AddInt32(fetches, 1)
+		return Credentials{AccessKeyId: fmt.Sprintf("AKID%d", n), Expiration: time.Now().Add(lifetime)}, nil
+	}
+}
+
+// Lifetime of credentials in tests waiting for them to be refreshed, which
+// happens halfway through it
+const shortLifetime = 200 * time.Millisecond
+
+// Hooks signalling refreshes to tests waiting for them, without ever
+// blocking the refresher. Successful refreshes nobody waits for are not
+// signalled, failures are buffered so that none is missed.
+type refreshSignal struct {
+	NopHooks
+	refreshed chan Credentials
+	failed    chan int
+}
+
+func newRefreshSignal() *refreshSignal {
+	return &refreshSignal{refreshed: make(chan Credentials), failed: make(chan int, 10)}
+}
+
+func (s *refreshSignal) RefreshSucceeded(creds Credentials) {
+	select {
+	case s.refreshed <- creds:
+	default:
+	}
+}
+
+func (s *refreshSignal) RefreshFailed(err error, failures int) {
+	select {
+	case s.failed <- failures:
+	default:
+	}
+}
+
+// Wait for the next successful refresh
+func (s *refreshSignal) wait(t *testing.T) Credentials {
+	select {
+	case creds := <-s.refreshed:
+		return creds
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected credentials to be refreshed")
+		return Credentials{}
+	}
+}
+
+// Wait for the next failed refresh, returning the number of consecutive
+// failures
+func (s *refreshSignal) waitFailed(t *testing.T) int {
+	select {
+	case failures := <-s.failed:
+		return failures
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected refreshing credentials to fail")
+		return 0
+	}
+}
+
+func TestCloseStopsRefresher(t *testing.T) {
+	var fetches int32
+	signal := newRefreshSignal()
+	provider, err := NewRefreshingCredentialsWithOptions(countingFetch(&fetches, shortLifetime), RefreshOptions{Hooks: signal})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signal.wait(t)
+	if err := provider.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closed := atomic.LoadInt32(&fetches)
+
+	// Refreshes would be due within shortLifetime if still running
+	select {
+	case <-signal.refreshed:
+		t.Fatal("Expected no refreshes after closing")
+	case <-time.After(shortLifetime):
+	}
+	if n := atomic.LoadInt32(&fetches); n != closed {
+		t.Fatalf("Expected no fetches after closing, got %d more", n-closed)
+	}
+
+	// Credentials fetched before closing are still available
+	retrieve(t, provider)
+	if err := provider.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContextStopsRefresher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var fetches int32
+	provider, err := NewRefreshingCredentialsWithOptions(countingFetch(&fetches, time.Hour), RefreshOptions{Context: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-provider.creds.done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected refresher to stop when its context is done")
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	var fetches int32
+	provider, err := NewRefreshingCredentials(countingFetch(&fetches, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	if err := provider.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKID2" {
+		t.Fatalf("Expected refreshed credentials, got %+v", creds)
+	}
+}
+
+func TestWaitForAsyncStart(t *testing.T) {
+	var available int32
+	fetch := func(ctx context.Context) (Credentials, error) {
+		if atomic.LoadInt32(&available) == 0 {
+			return Credentials{}, errors.New("not yet available")
+		}
+		return Credentials{AccessKeyId: "AKID", Expiration: time.Now().Add(time.Hour)}, nil
+	}
+
+	provider, err := NewRefreshingCredentialsWithOptions(fetch, RefreshOptions{StartAsync: true})
+	if err != nil {
+		t.Fatalf("Expected no error when starting asynchronously, got %s", err)
+	}
+	defer provider.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := provider.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected waiting to time out, got %v", err)
+	}
+	if _, err := provider.Retrieve(context.Background()); err == nil {
+		t.Fatal("Expected error before credentials are available")
+	}
+
+	atomic.StoreInt32(&available, 1)
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKID" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+	if err := provider.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	opts := RefreshOptions{Window: 5 * time.Minute, Jitter: time.Minute}
+	expiration := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	for i := 0; i < 100; i++ {
+		delay := opts.refreshDelay(expiration)
+		if delay < 53*time.Minute || delay > 55*time.Minute {
+			t.Fatalf("Expected refresh 5 to 6 minutes before expiry, got %s", delay)
+		}
+	}
+}
+
+func TestRefreshDelayShortLifetime(t *testing.T) {
+	opts := RefreshOptions{}.withDefaults()
+	expiration := time.Now().Add(10 * time.Second).Format(time.RFC3339)
+
+	// At most half of the remaining lifetime is spent waiting
+	delay := opts.refreshDelay(expiration)
+	if delay < 4*time.Second || delay > 6*time.Second {
+		t.Fatalf("Expected refresh halfway to expiry, got %s", delay)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	opts := RefreshOptions{MinRetryDelay: time.Second, MaxRetryDelay: 10 * time.Second}
+
+	for failures, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max *= time.Second
+		delay := opts.retryDelay(failures)
+		if delay < max/2 || delay > max {
+			t.Fatalf("Expected delay between %s and %s after %d failures, got %s", max/2, max, failures, delay)
+		}
+	}
+	if delay := opts.retryDelay(100); delay > 10*time.Second {
+		t.Fatalf("Expected delay capped at 10s, got %s", delay)
+	}
+}
+
+func TestRetryDelayLongOutage(t *testing.T) {
+	opts := RefreshOptions{MinRetryDelay: time.Minute, MaxRetryDelay: time.Hour}
+
+	// Doubling a minute 40 times would overflow
+	if delay := opts.retryDelay(40); delay < 30*time.Minute || delay > time.Hour {
+		t.Fatalf("Expected delay between 30m and 1h after 40 failures, got %s", delay)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []time.Time
+	fetch := func(ctx context.Context) (Credentials, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched = append(fetched, time.Now())
+		if len(fetched) > 1 {
+			return Credentials{}, errors.New("fetch failed")
+		}
+		return Credentials{AccessKeyId: "AKID", Expiration: time.Now().Add(shortLifetime)}, nil
+	}
+
+	signal := newRefreshSignal()
+	provider, err := NewRefreshingCredentialsWithOptions(fetch, RefreshOptions{
+		MinRetryDelay: 20 * time.Millisecond,
+		MaxRetryDelay: 80 * time.Millisecond,
+		Hooks:         signal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for expected := 1; expected <= 5; expected++ {
+		if failures := signal.waitFailed(t); failures != expected {
+			t.Fatalf("Expected %d consecutive failures, got %d", expected, failures)
+		}
+	}
+	provider.Close()
+
+	// Retries after at least 10, 20, 40 and 40ms
+	mu.Lock()
+	defer mu.Unlock()
+	if elapsed := fetched[5].Sub(fetched[1]); elapsed < 110*time.Millisecond {
+		t.Fatalf("Expected retries to back off, took %s", elapsed)
+	}
+}
+
+func TestExpiryMargin(t *testing.T) {
+	var fetches int32
+	provider, err := NewRefreshingCredentialsWithOptions(countingFetch(&fetches, 10*time.Minute), RefreshOptions{ExpiryMargin: 5 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	// Still valid for longer than the margin
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKID1" {
+		t.Fatalf("Expected cached credentials, got %+v", creds)
+	}
+
+	provider, err = NewRefreshingCredentialsWithOptions(countingFetch(&fetches, 2*time.Minute), RefreshOptions{ExpiryMargin: 5 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	// About to expire, so fetched on demand
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKID3" {
+		t.Fatalf("Expected credentials fetched on demand, got %+v", creds)
+	}
+}
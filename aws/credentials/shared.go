@@ -0,0 +1,248 @@
+// Reads named profiles from the shared credentials and config files used by
+// the AWS CLI and SDKs, ~/.aws/credentials and ~/.aws/config by default.
+//
+// Both files are in INI format. Profiles are sections named after the
+// profile in the credentials file, and prefixed with "profile " in the config
+// file (except for the default profile). Settings from the credentials file
+// take precedence.
+//
+// More info: http://docs.aws.amazon.com/cli/latest/userguide/cli-configure-files.html
+
+package credentials
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultProfile = "default"
+
+// SharedProfile holds the settings of a named profile from the shared
+// credentials and config files.
+type SharedProfile struct {
+	Name string
+
+	// Static credentials, if configured for the profile
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Default region for the profile, e.g. eu-west-1
+	Region string
+
+	// Role to assume using the credentials of SourceProfile
+	RoleArn         string
+	SourceProfile   string
+	ExternalId      string
+	RoleSessionName string
+
+	// External command printing credentials, see NewProcessCredentials
+	CredentialProcess string
+}
+
+// Initialise credentials with the static keys of a profile in the shared
+// credentials and config files. An empty profile selects the one named by
+// AWS_PROFILE, or the default profile. Returns an error if the profile has
+// no static keys.
+func NewSharedCredentials(profile string) (*Credentials, error) {
+	p, err := LoadSharedProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	return p.staticCredentials()
+}
+
+// Initialise credentials from the credential_process of a profile in the
+// shared credentials and config files, selected like for
+// NewSharedCredentials. Returns an error if the profile has no
+// credential_process or it fails.
+func NewSharedProcessCredentials(profile string) (*RefreshingCredentials, error) {
+	p, err := LoadSharedProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if p.CredentialProcess == "" {
+		return nil, fmt.Errorf("Profile %s has no credential_process", p.Name)
+	}
+	return NewProcessCredentials(p.CredentialProcess)
+}
+
+// Credentials of a profile in the shared credentials and config files: its
+// static keys if it has any, or else its credential_process
+func newSharedProfileCredentials(profile string) (Provider, error) {
+	p, err := LoadSharedProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if p.CredentialProcess != "" && (p.AccessKeyId == "" || p.SecretAccessKey == "") {
+		creds, err := NewProcessCredentials(p.CredentialProcess)
+		if err != nil {
+			return nil, err
+		}
+		return creds, nil
+	}
+	creds, err := p.staticCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("%v or credential_process", err)
+	}
+	return creds, nil
+}
+
+func (p *SharedProfile) staticCredentials() (*Credentials, error) {
+	if p.AccessKeyId == "" || p.SecretAccessKey == "" {
+		return nil, fmt.Errorf("Profile %s has no aws_access_key_id and aws_secret_access_key", p.Name)
+	}
+	return &Credentials{
+		AccessKeyId:     p.AccessKeyId,
+		SecretAccessKey: p.SecretAccessKey,
+		Token:           p.SessionToken,
+	}, nil
+}
+
+// Load a profile from the shared credentials and config files. An empty
+// profile selects the one named by AWS_PROFILE, or the default profile.
+//
+// The files are looked up at AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE,
+// defaulting to ~/.aws/credentials and ~/.aws/config. Either may be missing,
+// but the profile has to be present in at least one of them.
+func LoadSharedProfile(profile string) (*SharedProfile, error) {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = defaultProfile
+	}
+
+	credsFile, err := sharedFilePath("AWS_SHARED_CREDENTIALS_FILE", "credentials")
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := sharedFilePath("AWS_CONFIG_FILE", "config")
+	if err != nil {
+		return nil, err
+	}
+
+	configSection := "profile " + profile
+	if profile == defaultProfile {
+		configSection = defaultProfile
+	}
+
+	settings := map[string]string{}
+	found := false
+	for _, f := range []struct {
+		path    string
+		section string
+	}{{configFile, configSection}, {credsFile, profile}} {
+		sections, err := parseIniFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := sections[f.section]; ok {
+			found = true
+			for k, v := range s {
+				settings[k] = v
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Profile %s not found in %s or %s", profile, credsFile, configFile)
+	}
+
+	return &SharedProfile{
+		Name:            profile,
+		AccessKeyId:     settings["aws_access_key_id"],
+		SecretAccessKey: settings["aws_secret_access_key"],
+		SessionToken:    settings["aws_session_token"],
+		Region:          settings["region"],
+		RoleArn:         settings["role_arn"],
+		SourceProfile:   settings["source_profile"],
+		ExternalId:      settings["external_id"],
+		RoleSessionName: settings["role_session_name"],
+
+		CredentialProcess: settings["credential_process"],
+	}, nil
+}
+
+// Path of a shared file, taken from the environment variable env or
+// defaulting to name in ~/.aws
+func sharedFilePath(env string, name string) (string, error) {
+	if path := os.Getenv(env); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Cannot locate shared %s file: %v", name, err)
+	}
+	return filepath.Join(home, ".aws", name), nil
+}
+
+// Parse an INI file into its sections. A missing file has no sections.
+func parseIniFile(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	sections, err := parseIni(f)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse %s: %v", path, err)
+	}
+	return sections, nil
+}
+
+// Parse INI formatted settings into a map of sections to keys and values.
+// Keys are lower-cased. Comments start with '#' or ';'. Indented lines
+// following a key without a value hold nested settings, which are skipped.
+func parseIni(r io.Reader) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{}
+	var current map[string]string
+	nested := false
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if nested && raw[0] != line[0] {
+			continue
+		}
+		nested = false
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %d: unterminated section header", n)
+			}
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if sections[name] == nil {
+				sections[name] = map[string]string{}
+			}
+			current = sections[name]
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if current == nil {
+			return nil, fmt.Errorf("line %d: setting outside of a section", n)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		if value == "" {
+			nested = true
+		}
+		current[key] = value
+	}
+	return sections, scanner.Err()
+}
@@ -0,0 +1,134 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testCredentialsFile = `
+# Keys for the default profile
+[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = SECRETDEFAULT
+
+[development]
+aws_access_key_id=AKIDDEV
+aws_secret_access_key=SECRETDEV
+aws_session_token = TOKENDEV
+`
+
+	testConfigFile = `
+[default]
+region = us-east-1
+
+; Profiles in the config file are prefixed
+[profile development]
+region = eu-west-1
+s3 =
+    max_concurrent_requests = 20
+output = json
+
+[profile cross-account]
+role_arn = arn:aws:iam::123456789012:role/audio-reader
+source_profile = development
+external_id = shared-secret
+region = eu-central-1
+`
+)
+
+func writeSharedFiles(t *testing.T, credentials string, config string) {
+	dir := t.TempDir()
+	credsFile := filepath.Join(dir, "credentials")
+	configFile := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(credsFile, []byte(credentials), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, map[string]string{
+		"AWS_SHARED_CREDENTIALS_FILE": credsFile,
+		"AWS_CONFIG_FILE":             configFile,
+		"AWS_PROFILE":                 "",
+	})
+}
+
+func TestLoadSharedProfile(t *testing.T) {
+	writeSharedFiles(t, testCredentialsFile, testConfigFile)
+
+	p, err := LoadSharedProfile("development")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SharedProfile{
+		Name:            "development",
+		AccessKeyId:     "AKIDDEV",
+		SecretAccessKey: "SECRETDEV",
+		SessionToken:    "TOKENDEV",
+		Region:          "eu-west-1",
+	}
+	if *p != expected {
+		t.Fatalf("Expected profile %+v, got %+v", expected, *p)
+	}
+
+	p, err = LoadSharedProfile("cross-account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RoleArn != "arn:aws:iam::123456789012:role/audio-reader" || p.SourceProfile != "development" ||
+		p.ExternalId != "shared-secret" || p.Region != "eu-central-1" {
+		t.Fatalf("Unexpected role settings: %+v", *p)
+	}
+
+	if _, err := LoadSharedProfile("missing"); err == nil {
+		t.Fatal("Expected error for missing profile")
+	}
+}
+
+func TestSharedCredentialsProfileSelection(t *testing.T) {
+	writeSharedFiles(t, testCredentialsFile, testConfigFile)
+
+	provider, err := NewSharedCredentials("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKIDDEFAULT" || creds.Token != "" {
+		t.Fatalf("Expected default profile credentials, got %+v", creds)
+	}
+
+	setenv(t, map[string]string{"AWS_PROFILE": "development"})
+	provider, err = NewSharedCredentials("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := retrieve(t, provider); creds.AccessKeyId != "AKIDDEV" || creds.Token != "TOKENDEV" {
+		t.Fatalf("Expected AWS_PROFILE credentials, got %+v", creds)
+	}
+
+	if _, err := NewSharedCredentials("cross-account"); err == nil {
+		t.Fatal("Expected error for profile without static keys")
+	}
+}
+
+func TestSharedCredentialsMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	setenv(t, map[string]string{
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials"),
+		"AWS_CONFIG_FILE":             filepath.Join(dir, "config"),
+	})
+
+	if _, err := NewSharedCredentials("default"); err == nil {
+		t.Fatal("Expected error without shared files")
+	}
+}
+
+func TestParseIniErrors(t *testing.T) {
+	for _, invalid := range []string{"[default", "key = value", "[default]\nno value"} {
+		if _, err := parseIni(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected error parsing %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Client for the EC2 Metadata API of the instance the process runs on,
+// supporting both session-oriented (IMDSv2) and plain (IMDSv1) requests.
+//
+// With IMDSv2 a session token is obtained with a PUT request and sent along
+// with every subsequent metadata request. Tokens are renewed before their TTL
+// runs out. Instances can be configured to reject IMDSv1 requests, so falling
+// back to them needs to be explicitly enabled.
+//
+// Values describing the identity of the instance never change and are cached
+// once fetched. Tags, network interfaces and user data are cached for a
+// while.
+//
+// More info: http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/configuring-instance-metadata-service.html
+package ec2metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEndpoint = "http://169.254.169.254"
+
+	tokenPath       = "/latest/api/token"
+	tokenHeader     = "X-aws-ec2-metadata-token"
+	tokenTTLHeader  = "X-aws-ec2-metadata-token-ttl-seconds"
+	defaultTokenTTL = 6 * time.Hour
+	minTokenTTL     = time.Second
+	maxTokenTTL     = 6 * time.Hour
+	defaultTimeout  = 5 * time.Second
+	defaultCacheTTL = 5 * time.Minute
+)
+
+// ErrNotFound is returned, wrapped, for metadata that does not exist on the
+// instance, e.g. user data of an instance launched without any.
+var ErrNotFound = errors.New("EC2 Metadata not found")
+
+// Options configures how the EC2 Metadata API is queried.
+type Options struct {
+	// Base URL of the EC2 Metadata API. Defaults to the
+	// AWS_EC2_METADATA_SERVICE_ENDPOINT environment variable, or
+	// http://169.254.169.254 if not set.
+	Endpoint string
+
+	// Lifetime requested for IMDSv2 session tokens, between 1 second and
+	// 6 hours. Defaults to 6 hours. Values outside that range are clamped to
+	// it, as the API rejects them.
+	TokenTTL time.Duration
+
+	// Use plain IMDSv1 requests if no session token can be obtained. Off by
+	// default, as instances may be configured to reject them.
+	AllowIMDSv1Fallback bool
+
+	// How long tags, network interfaces and user data are cached. Defaults to
+	// 5 minutes. Negative values disable caching them.
+	CacheTTL time.Duration
+
+	// Timeout of each request. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// Client queries the EC2 Metadata API. It is safe for concurrent use.
+type Client struct {
+	endpoint string
+	client   *http.Client
+	opts     Options
+
+	mu          sync.Mutex // Mutex to synchronize token renewal
+	token       string
+	tokenExpiry time.Time
+
+	cacheMu sync.Mutex
+	cache   map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	body    []byte
+	expires time.Time // Zero if the entry never expires
+}
+
+// NewClient initialises a client configured by opts.
+func NewClient(opts Options) *Client {
+	if opts.Endpoint == "" {
+		opts.Endpoint = os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = DefaultEndpoint
+	}
+	switch {
+	case opts.TokenTTL <= 0:
+		opts.TokenTTL = defaultTokenTTL
+	case opts.TokenTTL < minTokenTTL:
+		opts.TokenTTL = minTokenTTL
+	case opts.TokenTTL > maxTokenTTL:
+		opts.TokenTTL = maxTokenTTL
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = defaultCacheTTL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	return &Client{
+		endpoint: strings.TrimSuffix(opts.Endpoint, "/"),
+		client:   &http.Client{Timeout: opts.Timeout},
+		opts:     opts,
+		cache:    make(map[string]cacheEntry),
+	}
+}
+
+// Get the contents of a metadata path, e.g. /latest/meta-data/instance-id,
+// without caching them
+func (c *Client) Get(ctx context.Context, path string) ([]byte, error) {
+	token, err := c.sessionToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status, body, err := c.do(ctx, path, token)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusUnauthorized && token != "" {
+		// Token was rejected, e.g. because the metadata service restarted.
+		// Start a new session and try once more.
+		c.expireToken()
+		if token, err = c.sessionToken(ctx); err != nil {
+			return nil, err
+		}
+		if status, body, err = c.do(ctx, path, token); err != nil {
+			return nil, err
+		}
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("EC2 Metadata returned status %d\n%s", status, body)
+	}
+	return body, nil
+}
+
+// Get the contents of a metadata path, caching them for ttl. A zero ttl
+// caches them for the lifetime of the client, a negative one not at all.
+func (c *Client) getCached(ctx context.Context, path string, ttl time.Duration) ([]byte, error) {
+	c.cacheMu.Lock()
+	entry, ok := c.cache[path]
+	c.cacheMu.Unlock()
+	if ok && (entry.expires.IsZero() || time.Now().Before(entry.expires)) {
+		return entry.body, nil
+	}
+
+	body, err := c.Get(ctx, path)
+	if err != nil || ttl < 0 {
+		return body, err
+	}
+	entry = cacheEntry{body: body}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.cacheMu.Lock()
+	c.cache[path] = entry
+	c.cacheMu.Unlock()
+	return body, nil
+}
+
+func (c *Client) do(ctx context.Context, path string, token string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.endpoint+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// Returns the current session token, requesting a new one if it is missing
+// or about to expire. Returns an empty token if IMDSv2 is unavailable and
+// falling back to IMDSv1 is allowed.
+func (c *Client) sessionToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Renew once less than a tenth of the TTL is left
+	if c.token != "" && time.Now().Before(c.tokenExpiry.Add(-c.opts.TokenTTL/10)) {
+		return c.token, nil
+	}
+
+	token, err := c.fetchToken(ctx)
+	if err != nil {
+		c.token = ""
+		if c.opts.AllowIMDSv1Fallback {
+			log.Printf("Could not get EC2 Metadata session token, falling back to IMDSv1: %s", err)
+			return "", nil
+		}
+		return "", err
+	}
+
+	c.token = token
+	c.tokenExpiry = time.Now().Add(c.opts.TokenTTL)
+	return c.token, nil
+}
+
+func (c *Client) fetchToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.endpoint+tokenPath, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(tokenTTLHeader, strconv.Itoa(int(c.opts.TokenTTL/time.Second)))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("EC2 Metadata session token request returned status %d\n%s", resp.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+func (c *Client) expireToken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
@@ -0,0 +1,162 @@
+package ec2metadata
+
+import (
+	"context"
+	"errors"
+	"github.com/soundcloud/sc-gaws/aws/credentials/metadatatest"
+	"os"
+	"testing"
+	"time"
+)
+
+const instanceIdPath = "/latest/meta-data/instance-id"
+
+func newTestServer(t *testing.T) *metadatatest.Server {
+	server := metadatatest.NewServer()
+	t.Cleanup(server.Close)
+	server.SetMetadata(instanceIdPath, "i-1234567890abcdef0")
+	return server
+}
+
+func TestSessionTokenRenewal(t *testing.T) {
+	server := newTestServer(t)
+	c := NewClient(Options{Endpoint: server.URL, TokenTTL: time.Minute})
+
+	if _, err := c.Get(context.Background(), instanceIdPath); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.LastTokenTTL(); ttl != time.Minute {
+		t.Fatalf("Expected token TTL of 60 seconds, got %s", ttl)
+	}
+
+	// Token about to run out
+	c.tokenExpiry = time.Now().Add(time.Second)
+	if _, err := c.Get(context.Background(), instanceIdPath); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.TokenRequests(); n != 2 {
+		t.Fatalf("Expected token to be renewed before expiry, %d tokens were requested", n)
+	}
+
+	// Token rejected by the metadata service
+	server.InvalidateTokens()
+	if _, err := c.Get(context.Background(), instanceIdPath); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.TokenRequests(); n != 3 {
+		t.Fatalf("Expected rejected token to be replaced, %d tokens were requested", n)
+	}
+}
+
+func TestTokenTTLClamped(t *testing.T) {
+	server := newTestServer(t)
+	for ttl, expected := range map[time.Duration]time.Duration{
+		500 * time.Millisecond: time.Second,
+		24 * time.Hour:         6 * time.Hour,
+	} {
+		c := NewClient(Options{Endpoint: server.URL, TokenTTL: ttl})
+		if _, err := c.Get(context.Background(), instanceIdPath); err != nil {
+			t.Fatalf("TTL %s: %s", ttl, err)
+		}
+		if requested := server.LastTokenTTL(); requested != expected {
+			t.Fatalf("Expected TTL %s to be clamped to %s, got %s", ttl, expected, requested)
+		}
+	}
+}
+
+func TestIMDSv1Fallback(t *testing.T) {
+	server := newTestServer(t)
+	server.SetIMDSv1(true)
+	server.SetIMDSv2(false)
+
+	c := NewClient(Options{Endpoint: server.URL})
+	if _, err := c.Get(context.Background(), instanceIdPath); err == nil {
+		t.Fatal("Expected error without IMDSv1 fallback")
+	}
+
+	c = NewClient(Options{Endpoint: server.URL, AllowIMDSv1Fallback: true})
+	if _, err := c.Get(context.Background(), instanceIdPath); err != nil {
+		t.Fatalf("Expected IMDSv1 fallback to succeed, got %s", err)
+	}
+}
+
+func TestEndpointFromEnv(t *testing.T) {
+	server := newTestServer(t)
+	old, ok := os.LookupEnv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	os.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", server.URL+"/")
+	defer func() {
+		if ok {
+			os.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", old)
+		} else {
+			os.Unsetenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+		}
+	}()
+
+	c := NewClient(Options{})
+	if _, err := c.Get(context.Background(), instanceIdPath); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Requests(instanceIdPath); n != 1 {
+		t.Fatalf("Expected request to the configured endpoint, got %d", n)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	server := newTestServer(t)
+	c := NewClient(Options{Endpoint: server.URL})
+
+	_, err := c.Get(context.Background(), "/latest/user-data")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+// Let all cached values that expire do so
+func expireCache(c *Client) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	for path, entry := range c.cache {
+		if !entry.expires.IsZero() {
+			entry.expires = time.Now().Add(-time.Second)
+			c.cache[path] = entry
+		}
+	}
+}
+
+func TestCaching(t *testing.T) {
+	server := newTestServer(t)
+	c := NewClient(Options{Endpoint: server.URL, CacheTTL: time.Hour})
+	server.SetMetadata(userDataPath, "#!/bin/sh")
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.InstanceId(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.UserData(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.Requests(instanceIdPath); n != 1 {
+		t.Fatalf("Expected instance ID to be cached, got %d requests", n)
+	}
+	if n := server.Requests(userDataPath); n != 1 {
+		t.Fatalf("Expected user data to be cached, got %d requests", n)
+	}
+
+	// User data may change, the instance ID never does
+	expireCache(c)
+	c.InstanceId(context.Background())
+	c.UserData(context.Background())
+	if n := server.Requests(instanceIdPath); n != 1 {
+		t.Fatalf("Expected instance ID to be cached, got %d requests", n)
+	}
+	if n := server.Requests(userDataPath); n != 2 {
+		t.Fatalf("Expected user data to be fetched again, got %d requests", n)
+	}
+
+	// Get never caches
+	c.Get(context.Background(), instanceIdPath)
+	if n := server.Requests(instanceIdPath); n != 2 {
+		t.Fatalf("Expected Get to bypass the cache, got %d requests", n)
+	}
+}
@@ -0,0 +1,234 @@
+package ec2metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	metadataPath         = "/latest/meta-data/"
+	identityDocumentPath = "/latest/dynamic/instance-identity/document"
+	identityPKCS7Path    = "/latest/dynamic/instance-identity/pkcs7"
+	userDataPath         = "/latest/user-data"
+	tagsPath             = metadataPath + "tags/instance/"
+	macsPath             = metadataPath + "network/interfaces/macs/"
+)
+
+// IdentityDocument describes the instance and the account it runs in.
+//
+// More info: http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
+type IdentityDocument struct {
+	AccountId        string    `json:"accountId"`
+	Architecture     string    `json:"architecture"`
+	AvailabilityZone string    `json:"availabilityZone"`
+	ImageId          string    `json:"imageId"`
+	InstanceId       string    `json:"instanceId"`
+	InstanceType     string    `json:"instanceType"`
+	KernelId         string    `json:"kernelId"`
+	PendingTime      time.Time `json:"pendingTime"`
+	PrivateIp        string    `json:"privateIp"`
+	RamdiskId        string    `json:"ramdiskId"`
+	Region           string    `json:"region"`
+	Version          string    `json:"version"`
+}
+
+// SignedIdentityDocument is an identity document together with its PKCS7
+// signature, which lets a third party verify where the instance runs.
+type SignedIdentityDocument struct {
+	Document IdentityDocument
+
+	// The document as returned by the EC2 Metadata API, which the signature
+	// was computed over
+	Raw []byte
+
+	// Base64 encoded PKCS7 signature of Raw
+	PKCS7 string
+}
+
+// NetworkInterface describes an elastic network interface attached to the
+// instance.
+type NetworkInterface struct {
+	Mac              string
+	DeviceNumber     int
+	InterfaceId      string
+	SubnetId         string
+	VpcId            string
+	LocalIpv4s       []string
+	PublicIpv4s      []string
+	Ipv6s            []string
+	SecurityGroupIds []string
+}
+
+// ID of the instance, e.g. i-1234567890abcdef0
+func (c *Client) InstanceId(ctx context.Context) (string, error) {
+	return c.getString(ctx, metadataPath+"instance-id")
+}
+
+// Type of the instance, e.g. m5.large
+func (c *Client) InstanceType(ctx context.Context) (string, error) {
+	return c.getString(ctx, metadataPath+"instance-type")
+}
+
+// Availability zone the instance runs in, e.g. eu-west-1a
+func (c *Client) AvailabilityZone(ctx context.Context) (string, error) {
+	return c.getString(ctx, metadataPath+"placement/availability-zone")
+}
+
+// Region the instance runs in, e.g. eu-west-1
+func (c *Client) Region(ctx context.Context) (string, error) {
+	region, err := c.getString(ctx, metadataPath+"placement/region")
+	if !errors.Is(err, ErrNotFound) {
+		return region, err
+	}
+
+	// Older metadata services only have it in the identity document. The
+	// availability zone can't be parsed for it, as names of Local Zones and
+	// Wavelength Zones like us-west-2-lax-1a don't end in the region.
+	doc, err := c.IdentityDocument(ctx)
+	if err != nil {
+		return "", err
+	}
+	return doc.Region, nil
+}
+
+// Identity document of the instance
+func (c *Client) IdentityDocument(ctx context.Context) (IdentityDocument, error) {
+	var doc IdentityDocument
+	body, err := c.getCached(ctx, identityDocumentPath, 0)
+	if err != nil {
+		return doc, err
+	}
+	err = json.Unmarshal(body, &doc)
+	return doc, err
+}
+
+// Identity document of the instance along with its signature
+func (c *Client) SignedIdentityDocument(ctx context.Context) (SignedIdentityDocument, error) {
+	var signed SignedIdentityDocument
+	doc, err := c.IdentityDocument(ctx)
+	if err != nil {
+		return signed, err
+	}
+	raw, err := c.getCached(ctx, identityDocumentPath, 0)
+	if err != nil {
+		return signed, err
+	}
+	pkcs7, err := c.getString(ctx, identityPKCS7Path)
+	if err != nil {
+		return signed, err
+	}
+	return SignedIdentityDocument{Document: doc, Raw: raw, PKCS7: pkcs7}, nil
+}
+
+// User data the instance was launched with. Returns an error wrapping
+// ErrNotFound if there is none.
+func (c *Client) UserData(ctx context.Context) ([]byte, error) {
+	return c.getCached(ctx, userDataPath, c.opts.CacheTTL)
+}
+
+// Tags of the instance. Requires access to tags in instance metadata to be
+// enabled for the instance, otherwise an error wrapping ErrNotFound is
+// returned.
+func (c *Client) Tags(ctx context.Context) (map[string]string, error) {
+	keys, err := c.list(ctx, tagsPath)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(keys))
+	for _, key := range keys {
+		body, err := c.getCached(ctx, tagsPath+key, c.opts.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		tags[key] = string(body)
+	}
+	return tags, nil
+}
+
+// Network interfaces attached to the instance, ordered by device number
+func (c *Client) NetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	macs, err := c.list(ctx, macsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []NetworkInterface
+	for _, mac := range macs {
+		path := macsPath + mac + "/"
+		iface := NetworkInterface{Mac: mac}
+		device, err := c.getDynamic(ctx, path+"device-number")
+		if err != nil {
+			return nil, err
+		}
+		if iface.DeviceNumber, err = strconv.Atoi(device); err != nil {
+			return nil, err
+		}
+		if iface.InterfaceId, err = c.getDynamic(ctx, path+"interface-id"); err != nil {
+			return nil, err
+		}
+		if iface.SubnetId, err = c.getDynamic(ctx, path+"subnet-id"); err != nil {
+			return nil, err
+		}
+		if iface.VpcId, err = c.getDynamic(ctx, path+"vpc-id"); err != nil {
+			return nil, err
+		}
+		if iface.LocalIpv4s, err = c.listOptional(ctx, path+"local-ipv4s"); err != nil {
+			return nil, err
+		}
+		if iface.PublicIpv4s, err = c.listOptional(ctx, path+"public-ipv4s"); err != nil {
+			return nil, err
+		}
+		if iface.Ipv6s, err = c.listOptional(ctx, path+"ipv6s"); err != nil {
+			return nil, err
+		}
+		if iface.SecurityGroupIds, err = c.listOptional(ctx, path+"security-group-ids"); err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, iface)
+	}
+
+	sort.Slice(interfaces, func(i, j int) bool {
+		return interfaces[i].DeviceNumber < interfaces[j].DeviceNumber
+	})
+	return interfaces, nil
+}
+
+// Get a value that never changes, caching it for the lifetime of the client
+func (c *Client) getString(ctx context.Context, path string) (string, error) {
+	body, err := c.getCached(ctx, path, 0)
+	return strings.TrimSpace(string(body)), err
+}
+
+// Get a value that may change, caching it for Options.CacheTTL
+func (c *Client) getDynamic(ctx context.Context, path string) (string, error) {
+	body, err := c.getCached(ctx, path, c.opts.CacheTTL)
+	return strings.TrimSpace(string(body)), err
+}
+
+// Get the entries of a listing, one per line, without trailing slashes of
+// nested listings
+func (c *Client) list(ctx context.Context, path string) ([]string, error) {
+	body, err := c.getCached(ctx, path, c.opts.CacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, line := range strings.Fields(string(body)) {
+		entries = append(entries, strings.TrimSuffix(line, "/"))
+	}
+	return entries, nil
+}
+
+// Like list, but returns no entries if path does not exist
+func (c *Client) listOptional(ctx context.Context, path string) ([]string, error) {
+	entries, err := c.list(ctx, path)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return entries, err
+}
@@ -0,0 +1,148 @@
+package ec2metadata
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testIdentityDocument = `{
+  "accountId" : "123456789012",
+  "architecture" : "x86_64",
+  "availabilityZone" : "eu-west-1b",
+  "imageId" : "ami-5fb8c835",
+  "instanceId" : "i-1234567890abcdef0",
+  "instanceType" : "m5.large",
+  "pendingTime" : "2016-11-19T16:32:11Z",
+  "privateIp" : "10.158.112.84",
+  "region" : "eu-west-1",
+  "version" : "2017-09-30"
+}`
+
+func TestInstanceIdentity(t *testing.T) {
+	server := newTestServer(t)
+	server.SetMetadata(metadataPath+"instance-type", "m5.large")
+	server.SetMetadata(metadataPath+"placement/availability-zone", "eu-west-1b")
+	c := NewClient(Options{Endpoint: server.URL})
+	ctx := context.Background()
+
+	if id, err := c.InstanceId(ctx); err != nil || id != "i-1234567890abcdef0" {
+		t.Fatalf("Unexpected instance ID %s: %v", id, err)
+	}
+	if typ, err := c.InstanceType(ctx); err != nil || typ != "m5.large" {
+		t.Fatalf("Unexpected instance type %s: %v", typ, err)
+	}
+	if zone, err := c.AvailabilityZone(ctx); err != nil || zone != "eu-west-1b" {
+		t.Fatalf("Unexpected availability zone %s: %v", zone, err)
+	}
+
+	// From the identity document without placement/region, including in
+	// Local Zones whose name doesn't start with the region
+	server.SetMetadata(metadataPath+"placement/availability-zone", "us-west-2-lax-1a")
+	server.SetMetadata(identityDocumentPath, strings.Replace(testIdentityDocument, "eu-west-1", "us-west-2", -1))
+	if region, err := c.Region(ctx); err != nil || region != "us-west-2" {
+		t.Fatalf("Unexpected region %s: %v", region, err)
+	}
+	server.SetMetadata(metadataPath+"placement/region", "us-gov-west-1")
+	if region, err := NewClient(Options{Endpoint: server.URL}).Region(ctx); err != nil || region != "us-gov-west-1" {
+		t.Fatalf("Unexpected region %s: %v", region, err)
+	}
+}
+
+func TestSignedIdentityDocument(t *testing.T) {
+	server := newTestServer(t)
+	server.SetMetadata(identityDocumentPath, testIdentityDocument)
+	server.SetMetadata(identityPKCS7Path, "MIAGCSqGSIb3DQEHAqCAMIACAQExCzAJBgUrDgMCGgUAMIAGCSqGSIb3DQEHAaCA")
+	c := NewClient(Options{Endpoint: server.URL})
+
+	signed, err := c.SignedIdentityDocument(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := signed.Document
+	if doc.AccountId != "123456789012" || doc.InstanceId != "i-1234567890abcdef0" || doc.Region != "eu-west-1" || doc.PendingTime.Year() != 2016 {
+		t.Fatalf("Unexpected identity document: %+v", doc)
+	}
+	if string(signed.Raw) != testIdentityDocument || signed.PKCS7 == "" {
+		t.Fatalf("Unexpected signed identity document: %+v", signed)
+	}
+}
+
+func TestTags(t *testing.T) {
+	server := newTestServer(t)
+	c := NewClient(Options{Endpoint: server.URL})
+
+	if _, err := c.Tags(context.Background()); err == nil {
+		t.Fatal("Expected error without access to tags")
+	}
+
+	server.SetMetadata(tagsPath, "Name\nteam")
+	server.SetMetadata(tagsPath+"Name", "web-1")
+	server.SetMetadata(tagsPath+"team", "audio")
+	tags, err := NewClient(Options{Endpoint: server.URL}).Tags(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, map[string]string{"Name": "web-1", "team": "audio"}) {
+		t.Fatalf("Unexpected tags: %v", tags)
+	}
+}
+
+func TestNetworkInterfaces(t *testing.T) {
+	server := newTestServer(t)
+	server.SetMetadata(macsPath, "0e:00:00:00:00:02/\n0e:00:00:00:00:01/")
+	for mac, fields := range map[string]map[string]string{
+		"0e:00:00:00:00:01": {
+			"device-number":      "0",
+			"interface-id":       "eni-1",
+			"subnet-id":          "subnet-1",
+			"vpc-id":             "vpc-1",
+			"local-ipv4s":        "10.0.0.1\n10.0.0.2",
+			"public-ipv4s":       "203.0.113.1",
+			"security-group-ids": "sg-1\nsg-2",
+		},
+		"0e:00:00:00:00:02": {
+			"device-number": "1",
+			"interface-id":  "eni-2",
+			"subnet-id":     "subnet-2",
+			"vpc-id":        "vpc-1",
+			"local-ipv4s":   "10.0.1.1",
+			"ipv6s":         "2001:db8::1",
+		},
+	} {
+		for field, value := range fields {
+			server.SetMetadata(macsPath+mac+"/"+field, value)
+		}
+	}
+	c := NewClient(Options{Endpoint: server.URL})
+
+	interfaces, err := c.NetworkInterfaces(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []NetworkInterface{
+		{
+			Mac:              "0e:00:00:00:00:01",
+			DeviceNumber:     0,
+			InterfaceId:      "eni-1",
+			SubnetId:         "subnet-1",
+			VpcId:            "vpc-1",
+			LocalIpv4s:       []string{"10.0.0.1", "10.0.0.2"},
+			PublicIpv4s:      []string{"203.0.113.1"},
+			SecurityGroupIds: []string{"sg-1", "sg-2"},
+		},
+		{
+			Mac:          "0e:00:00:00:00:02",
+			DeviceNumber: 1,
+			InterfaceId:  "eni-2",
+			SubnetId:     "subnet-2",
+			VpcId:        "vpc-1",
+			LocalIpv4s:   []string{"10.0.1.1"},
+			Ipv6s:        []string{"2001:db8::1"},
+		},
+	}
+	if !reflect.DeepEqual(interfaces, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, interfaces)
+	}
+}
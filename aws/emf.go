@@ -0,0 +1,168 @@
+// Types and functions to write metrics in CloudWatch Embedded Metric Format
+//
+// Every metric is written as a JSON line to a writer like stdout. Where the
+// output ends up in CloudWatch Logs, e.g. for containers using the awslogs
+// driver or Lambda functions, CloudWatch extracts the metrics from it without
+// any PutMetricData requests.
+//
+// Histograms are written as their values and counts, split into lines of at
+// most 100 values. EMF has no statistic sets, so other metrics are written as
+// their value, i.e. the average of their samples, or the sum for Count units.
+// Use histograms where the minimum, maximum or percentiles of samples matter.
+//
+// More info: http://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/stats"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of values of a metric in one line
+	maxEmfValues = 100
+
+	// Key of the metadata in a line
+	emfMetadataKey = "_aws"
+)
+
+// EmfStatsPusher implements the StatsPusher interface to write metrics in
+// Embedded Metric Format. It is safe for concurrent use.
+type EmfStatsPusher struct {
+	// Writer the JSON lines are written to, e.g. os.Stdout
+	Writer io.Writer
+
+	// Namespace for the metric e.g. bobone-cluster1, bobone-cluster2
+	Namespace string
+
+	mu sync.Mutex
+}
+
+// Initialise a pusher writing metrics in namespace to w
+func NewEmfStatsPusher(w io.Writer, namespace string) *EmfStatsPusher {
+	return &EmfStatsPusher{Writer: w, Namespace: namespace}
+}
+
+type emfMetadata struct {
+	Timestamp         int64
+	CloudWatchMetrics []emfDirective
+}
+
+type emfDirective struct {
+	Namespace  string
+	Dimensions [][]string
+	Metrics    []emfMetric
+}
+
+type emfMetric struct {
+	Name              string
+	Unit              string `json:",omitempty"`
+	StorageResolution int    `json:",omitempty"`
+}
+
+// Histogram value of a metric, summarised by the statistics CloudWatch
+// requires along with the values and their counts
+type emfHistogram struct {
+	Values []float64
+	Counts []float64
+	Max    float64
+	Min    float64
+	Count  float64
+	Sum    float64
+}
+
+// Write a slice of metrics, one line each, logging errors
+func (p *EmfStatsPusher) Push(metrics []stats.Metric) {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		for _, value := range emfValues(m) {
+			line, err := p.marshal(m, value)
+			if err != nil {
+				log.Printf("Encoding metric %s failed with error: %s", m.Name, err)
+				break
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.Writer.Write(buf.Bytes()); err != nil {
+		log.Printf("Writing metrics failed with error: %s", err)
+	}
+}
+
+// Marshal m with value into an Embedded Metric Format document. Returns an
+// error if the name of m or of a dimension would overwrite another key.
+func (p *EmfStatsPusher) marshal(m stats.Metric, value interface{}) ([]byte, error) {
+	if m.Name == emfMetadataKey {
+		return nil, fmt.Errorf("Metric name %s is reserved for metadata", m.Name)
+	}
+	timestamp := m.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	names := make([]string, 0, len(m.Dimensions))
+	for name := range m.Dimensions {
+		if name == emfMetadataKey || name == m.Name {
+			return nil, fmt.Errorf("Dimension %s collides with the metric or its metadata", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	doc := map[string]interface{}{
+		emfMetadataKey: emfMetadata{
+			Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+			CloudWatchMetrics: []emfDirective{{
+				Namespace:  p.Namespace,
+				Dimensions: [][]string{names},
+				Metrics:    []emfMetric{{Name: m.Name, Unit: m.Unit, StorageResolution: m.Resolution()}},
+			}},
+		},
+		m.Name: value,
+	}
+	for name, value := range m.Dimensions {
+		doc[name] = value
+	}
+	return json.Marshal(doc)
+}
+
+// Values of m, one per line. Histograms are written as their values and
+// counts, so that percentiles are still calculated from them, split into
+// lines of at most maxEmfValues values.
+func emfValues(m stats.Metric) []interface{} {
+	if len(m.Values) == 0 {
+		return []interface{}{m.Value}
+	}
+	var lines []interface{}
+	for start := 0; start < len(m.Values); start += maxEmfValues {
+		end := start + maxEmfValues
+		if end > len(m.Values) {
+			end = len(m.Values)
+		}
+		h := emfHistogram{Values: m.Values[start:end], Counts: make([]float64, end-start)}
+		h.Min, h.Max = h.Values[0], h.Values[0]
+		for i, v := range h.Values {
+			h.Counts[i] = 1
+			if start+i < len(m.Counts) {
+				h.Counts[i] = m.Counts[start+i]
+			}
+			h.Count += h.Counts[i]
+			h.Sum += v * h.Counts[i]
+			h.Min = math.Min(h.Min, v)
+			h.Max = math.Max(h.Max, v)
+		}
+		lines = append(lines, h)
+	}
+	return lines
+}
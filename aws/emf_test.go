@@ -0,0 +1,109 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/soundcloud/sc-gaws/stats"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmfPush(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewEmfStatsPusher(&buf, "test")
+	ts := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	p.Push([]stats.Metric{
+		{Name: "Requests", Value: 3, Unit: "Count", Timestamp: ts},
+		{Name: "Latency", Value: 12.5, Unit: "Milliseconds", Timestamp: ts, StorageResolution: 1, Dimensions: map[string]string{"Host": "web-1", "Endpoint": "/tracks"}},
+	})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per metric, got %q", buf.String())
+	}
+
+	var doc struct {
+		Aws      emfMetadata `json:"_aws"`
+		Latency  float64
+		Host     string
+		Endpoint string
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	expected := emfMetadata{
+		Timestamp: ts.Unix() * 1000,
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  "test",
+			Dimensions: [][]string{{"Endpoint", "Host"}},
+			Metrics:    []emfMetric{{Name: "Latency", Unit: "Milliseconds", StorageResolution: 1}},
+		}},
+	}
+	if !reflect.DeepEqual(doc.Aws, expected) {
+		t.Fatalf("Expected metadata %+v, got %+v", expected, doc.Aws)
+	}
+	if doc.Latency != 12.5 || doc.Host != "web-1" || doc.Endpoint != "/tracks" {
+		t.Fatalf("Unexpected line: %s", lines[1])
+	}
+
+	// Without dimensions
+	if !strings.Contains(lines[0], `"Dimensions":[[]]`) || !strings.Contains(lines[0], `"Requests":3`) {
+		t.Fatalf("Unexpected line: %s", lines[0])
+	}
+}
+
+func TestEmfHistogram(t *testing.T) {
+	m := stats.Metric{Name: "Latency", Value: 12, Values: []float64{5, 20}, Counts: []float64{2, 1.5}}
+	expected := emfHistogram{Values: []float64{5, 20}, Counts: []float64{2, 1.5}, Max: 20, Min: 5, Count: 3.5, Sum: 40}
+	if v := emfValues(m); !reflect.DeepEqual(v, []interface{}{expected}) {
+		t.Fatalf("Expected histogram %+v, got %+v", expected, v)
+	}
+
+	// Large counts do not grow the output
+	m.Counts = []float64{1e9, 1e9}
+	var buf bytes.Buffer
+	NewEmfStatsPusher(&buf, "test").Push([]stats.Metric{m})
+	if !strings.Contains(buf.String(), `"Latency":{"Values":[5,20],"Counts":[1000000000,1000000000],"Max":20,"Min":5,"Count":2000000000,"Sum":25000000000}`) {
+		t.Fatalf("Unexpected line: %s", buf.String())
+	}
+
+	// Too many values for one line
+	m.Values = make([]float64, 201)
+	m.Counts = nil
+	for i := range m.Values {
+		m.Values[i] = float64(i)
+	}
+	v := emfValues(m)
+	if len(v) != 3 {
+		t.Fatalf("Expected values to be split into 3 lines, got %d", len(v))
+	}
+	for i, n := range []int{100, 100, 1} {
+		if h := v[i].(emfHistogram); len(h.Values) != n || len(h.Counts) != n || h.Count != float64(n) {
+			t.Fatalf("Expected %d values in line %d, got %+v", n, i, h)
+		}
+	}
+	if h := v[1].(emfHistogram); h.Min != 100 || h.Max != 199 {
+		t.Fatalf("Unexpected values in line 1: %+v", h)
+	}
+}
+
+func TestEmfKeyCollision(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewEmfStatsPusher(&buf, "test")
+	p.Push([]stats.Metric{
+		{Name: "Latency", Value: 1, Dimensions: map[string]string{"_aws": "x"}},
+		{Name: "Latency", Value: 2, Dimensions: map[string]string{"Latency": "x"}},
+		{Name: "_aws", Value: 3},
+		{Name: "Requests", Value: 4, Dimensions: map[string]string{"Host": "web-1"}},
+	})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"Requests":4`) {
+		t.Fatalf("Expected metrics with colliding keys to be rejected, got %q", buf.String())
+	}
+	if _, err := p.marshal(stats.Metric{Name: "Latency", Dimensions: map[string]string{"Latency": "x"}}, 1); err == nil {
+		t.Fatal("Expected error for dimension named like the metric")
+	}
+}
@@ -0,0 +1,95 @@
+// Types and functions to resolve the endpoints of AWS services
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Partition is a group of AWS regions sharing a DNS suffix, e.g. the AWS
+// China regions.
+type Partition struct {
+	Name string
+
+	// Prefix of the names of the regions in the partition, empty for the
+	// default partition
+	RegionPrefix string
+
+	DNSSuffix          string
+	DualStackDNSSuffix string
+}
+
+// Partitions endpoints are resolved in. Regions not matching the prefix of
+// any other partition are in the aws partition.
+var Partitions = []Partition{
+	{Name: "aws-cn", RegionPrefix: "cn-", DNSSuffix: "amazonaws.com.cn", DualStackDNSSuffix: "api.amazonwebservices.com.cn"},
+	{Name: "aws-us-gov", RegionPrefix: "us-gov-", DNSSuffix: "amazonaws.com", DualStackDNSSuffix: "api.aws"},
+	{Name: "aws", DNSSuffix: "amazonaws.com", DualStackDNSSuffix: "api.aws"},
+}
+
+// Partition of region
+func PartitionForRegion(region string) Partition {
+	for _, p := range Partitions {
+		if p.RegionPrefix != "" && strings.HasPrefix(region, p.RegionPrefix) {
+			return p
+		}
+	}
+	return Partitions[len(Partitions)-1]
+}
+
+// EndpointResolver builds the URLs of AWS service endpoints from the name of
+// the service, e.g. monitoring or sqs, and the region.
+type EndpointResolver struct {
+	// Endpoint URLs by service name, used instead of resolving them, e.g.
+	// {"monitoring": "http://localhost:4566"} for LocalStack
+	Overrides map[string]string
+
+	// Resolve FIPS 140-2 validated endpoints
+	UseFIPS bool
+
+	// Resolve endpoints reachable over both IPv4 and IPv6
+	UseDualStack bool
+}
+
+// DefaultEndpointResolver resolves the standard endpoints without overrides.
+var DefaultEndpointResolver = &EndpointResolver{}
+
+// Resolve the endpoint URL of service in region, which defaults to
+// us-east-1.
+func (r *EndpointResolver) Resolve(service string, region string) (string, error) {
+	if service == "" {
+		return "", errors.New("No service given to resolve endpoint for")
+	}
+	if endpoint, ok := r.Overrides[service]; ok {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return "", fmt.Errorf("Invalid endpoint override for %s: %s", service, endpoint)
+		}
+		return strings.TrimSuffix(endpoint, "/"), nil
+	}
+
+	if region == "" {
+		region = defaultRegion
+	}
+	if strings.ContainsAny(region, "./:") {
+		return "", fmt.Errorf("Invalid region: %s", region)
+	}
+
+	partition := PartitionForRegion(region)
+	host, suffix := service, partition.DNSSuffix
+	if r.UseFIPS {
+		host += "-fips"
+	}
+	if r.UseDualStack {
+		suffix = partition.DualStackDNSSuffix
+	}
+	return fmt.Sprintf("https://%s.%s.%s", host, region, suffix), nil
+}
+
+// Resolve the endpoint URL of service in region with the
+// DefaultEndpointResolver
+func ResolveEndpoint(service string, region string) (string, error) {
+	return DefaultEndpointResolver.Resolve(service, region)
+}
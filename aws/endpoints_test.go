@@ -0,0 +1,61 @@
+package aws
+
+import (
+	"testing"
+)
+
+func TestResolveEndpoint(t *testing.T) {
+	tests := []struct {
+		resolver EndpointResolver
+		service  string
+		region   string
+		expected string
+	}{
+		{EndpointResolver{}, "monitoring", "eu-west-1", "https://monitoring.eu-west-1.amazonaws.com"},
+		{EndpointResolver{}, "monitoring", "", "https://monitoring.us-east-1.amazonaws.com"},
+		{EndpointResolver{}, "sqs", "cn-north-1", "https://sqs.cn-north-1.amazonaws.com.cn"},
+		{EndpointResolver{}, "sqs", "us-gov-west-1", "https://sqs.us-gov-west-1.amazonaws.com"},
+		{EndpointResolver{UseFIPS: true}, "sqs", "us-gov-west-1", "https://sqs-fips.us-gov-west-1.amazonaws.com"},
+		{EndpointResolver{UseDualStack: true}, "sqs", "eu-west-1", "https://sqs.eu-west-1.api.aws"},
+		{EndpointResolver{UseDualStack: true}, "sqs", "cn-northwest-1", "https://sqs.cn-northwest-1.api.amazonwebservices.com.cn"},
+		{EndpointResolver{UseFIPS: true, UseDualStack: true}, "monitoring", "us-east-1", "https://monitoring-fips.us-east-1.api.aws"},
+		{EndpointResolver{Overrides: map[string]string{"monitoring": "http://localhost:4566/"}}, "monitoring", "eu-west-1", "http://localhost:4566"},
+		{EndpointResolver{Overrides: map[string]string{"monitoring": "http://localhost:4566"}}, "sqs", "eu-west-1", "https://sqs.eu-west-1.amazonaws.com"},
+	}
+
+	for _, test := range tests {
+		endpoint, err := test.resolver.Resolve(test.service, test.region)
+		if err != nil {
+			t.Fatalf("Resolving %s in %s failed: %s", test.service, test.region, err)
+		}
+		if endpoint != test.expected {
+			t.Fatalf("Expected %s for %s in %s with %+v, got %s", test.expected, test.service, test.region, test.resolver, endpoint)
+		}
+	}
+}
+
+func TestResolveInvalidEndpoint(t *testing.T) {
+	if _, err := ResolveEndpoint("", "eu-west-1"); err == nil {
+		t.Fatal("Expected error without service")
+	}
+	if _, err := ResolveEndpoint("sqs", "evil.com/"); err == nil {
+		t.Fatal("Expected error for invalid region")
+	}
+	resolver := EndpointResolver{Overrides: map[string]string{"sqs": "localhost:4566"}}
+	if _, err := resolver.Resolve("sqs", "eu-west-1"); err == nil {
+		t.Fatal("Expected error for override without scheme")
+	}
+}
+
+func TestPartitionForRegion(t *testing.T) {
+	for region, partition := range map[string]string{
+		"eu-west-1":     "aws",
+		"us-east-1":     "aws",
+		"cn-north-1":    "aws-cn",
+		"us-gov-east-1": "aws-us-gov",
+	} {
+		if p := PartitionForRegion(region); p.Name != partition {
+			t.Fatalf("Expected partition %s for %s, got %s", partition, region, p.Name)
+		}
+	}
+}
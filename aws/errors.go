@@ -0,0 +1,162 @@
+package aws
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Error codes of throttled requests, which are retried after backing off
+var throttlingErrorCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"TransactionInProgressException":         true,
+	"RequestLimitExceeded":                   true,
+	"BandwidthLimitExceeded":                 true,
+	"LimitExceededException":                 true,
+	"SlowDown":                               true,
+	"PriorRequestNotComplete":                true,
+	"EC2ThrottledException":                  true,
+}
+
+// Error codes of transient failures, which may succeed when retried
+var transientErrorCodes = map[string]bool{
+	"RequestTimeout":          true,
+	"RequestTimeoutException": true,
+	"InternalError":           true,
+	"InternalFailure":         true,
+	"ServiceUnavailable":      true,
+	"IDPCommunicationError":   true,
+}
+
+// Error is returned by AWS services for requests they could not process.
+// Use errors.As to inspect errors returned by the clients in this package:
+//
+//	var awsErr *aws.Error
+//	if errors.As(err, &awsErr) && awsErr.Code == "AccessDenied" {
+type Error struct {
+	// Error code, e.g. AccessDenied or Throttling
+	Code string
+
+	Message string
+
+	// Whether the request was at fault (Sender) or AWS (Receiver), if known
+	Type string
+
+	// HTTP status code of the response
+	StatusCode int
+
+	// ID identifying the request to AWS support
+	RequestId string
+
+	// Delay before retrying requested by AWS, if any
+	RetryAfter time.Duration
+
+	// Whether the request was rejected because of a skewed clock, which has
+	// been corrected since
+	clockSkewCorrected bool
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s (status code %d", e.Code, e.StatusCode)
+	if e.RequestId != "" {
+		msg += ", request " + e.RequestId
+	}
+	msg += ")"
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Whether the request was throttled by AWS and should be retried after
+// backing off
+func (e *Error) Throttling() bool {
+	return throttlingErrorCodes[e.Code] || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Whether retrying the request may succeed: throttled requests, failures on
+// the side of AWS and requests signed with a skewed clock
+func (e *Error) Retryable() bool {
+	if e.Throttling() || transientErrorCodes[e.Code] || e.clockSkewCorrected {
+		return true
+	}
+	switch e.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Whether the request itself is at fault, e.g. for invalid parameters or
+// missing permissions, so that retrying it would fail again
+func (e *Error) ClientError() bool {
+	if e.Retryable() {
+		return false
+	}
+	return e.Type == "Sender" || (e.StatusCode >= 400 && e.StatusCode < 500)
+}
+
+// Whether err is, or wraps, an *Error for a throttled request
+func IsThrottling(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Throttling()
+}
+
+// Whether err is, or wraps, an *Error for a request that may succeed when
+// retried
+func IsRetryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable()
+}
+
+// Whether err is, or wraps, an *Error for a request at fault
+func IsClientError(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.ClientError()
+}
+
+// Error response of the Query protocol. Some services put the request ID
+// into the response metadata.
+type errorResponse struct {
+	Type      string `xml:"Error>Type"`
+	Code      string `xml:"Error>Code"`
+	Message   string `xml:"Error>Message"`
+	RequestId string
+	Metadata  string `xml:"ResponseMetadata>RequestId"`
+}
+
+// Parse the error response of a failed request. The body is used as the
+// message if it is not an ErrorResponse document.
+func parseError(res *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: res.StatusCode}
+	var doc errorResponse
+	if xml.Unmarshal(body, &doc) == nil && doc.Code != "" {
+		e.Code, e.Message, e.Type, e.RequestId = doc.Code, doc.Message, doc.Type, doc.RequestId
+		if e.RequestId == "" {
+			e.RequestId = doc.Metadata
+		}
+	} else {
+		// e.g. ServiceUnavailable
+		e.Code, e.Message = strings.ReplaceAll(http.StatusText(res.StatusCode), " ", ""), string(body)
+		if e.Code == "" {
+			e.Code = "UnknownError"
+		}
+	}
+	if e.RequestId == "" {
+		e.RequestId = res.Header.Get("X-Amzn-Requestid")
+	}
+	if e.RequestId == "" {
+		e.RequestId = res.Header.Get("X-Amz-Request-Id")
+	}
+	e.RetryAfter = retryAfter(res)
+	return e
+}
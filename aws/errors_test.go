@@ -0,0 +1,61 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		err         Error
+		throttling  bool
+		retryable   bool
+		clientError bool
+	}{
+		{Error{Code: "Throttling", Type: "Sender", StatusCode: 400}, true, true, false},
+		{Error{Code: "RequestLimitExceeded", StatusCode: 503}, true, true, false},
+		{Error{Code: "TooManyRequests", StatusCode: 429}, true, true, false},
+		{Error{Code: "InternalFailure", Type: "Receiver", StatusCode: 500}, false, true, false},
+		{Error{Code: "ServiceUnavailable", StatusCode: 503}, false, true, false},
+		{Error{Code: "RequestTimeout", StatusCode: 400}, false, true, false},
+		{Error{Code: "AccessDenied", Type: "Sender", StatusCode: 403}, false, false, true},
+		{Error{Code: "InvalidParameterValue", StatusCode: 400}, false, false, true},
+	}
+
+	for _, test := range tests {
+		err := fmt.Errorf("SendMessage failed: %w", &test.err)
+		if IsThrottling(err) != test.throttling || IsRetryable(err) != test.retryable || IsClientError(err) != test.clientError {
+			t.Fatalf("Expected %s to be classified as throttling %t, retryable %t, client error %t", test.err.Code, test.throttling, test.retryable, test.clientError)
+		}
+	}
+
+	if IsThrottling(errors.New("Throttling")) || IsRetryable(errors.New("oops")) || IsClientError(nil) {
+		t.Fatal("Expected other errors not to be classified")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	res := &http.Response{StatusCode: 400, Header: http.Header{}}
+	e := parseError(res, []byte(testErrorResponse))
+	if e.Code != "InvalidParameterValue" || e.Type != "Sender" || e.RequestId != "42d59b56-7407-4c4a-be0f-4c88daeea257" {
+		t.Fatalf("Unexpected error: %+v", e)
+	}
+
+	// Request ID in the response metadata
+	e = parseError(res, []byte(`<ErrorResponse><Error><Code>AccessDenied</Code></Error><ResponseMetadata><RequestId>abc</RequestId></ResponseMetadata></ErrorResponse>`))
+	if e.Code != "AccessDenied" || e.RequestId != "abc" {
+		t.Fatalf("Unexpected error: %+v", e)
+	}
+
+	// Not an error response, request ID in a header
+	res = &http.Response{StatusCode: 503, Header: http.Header{"X-Amzn-Requestid": {"def"}}}
+	e = parseError(res, []byte("<html>Service Unavailable</html>"))
+	if e.Code != "ServiceUnavailable" || e.RequestId != "def" || e.Message != "<html>Service Unavailable</html>" {
+		t.Fatalf("Unexpected error: %+v", e)
+	}
+	if msg := e.Error(); msg != "ServiceUnavailable (status code 503, request def): <html>Service Unavailable</html>" {
+		t.Fatalf("Unexpected error message: %s", msg)
+	}
+}
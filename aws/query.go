@@ -0,0 +1,196 @@
+// Client for AWS services using the Query protocol, like CloudWatch, SQS and
+// STS.
+//
+// Actions are called with POST requests whose form encoded body holds the
+// action, API version and parameters. Responses are XML documents.
+//
+// More info: http://docs.aws.amazon.com/AWSSimpleQueueService/latest/SQSDeveloperGuide/sqs-making-api-requests.html
+package aws
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"github.com/soundcloud/sc-gaws/stats"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultQueryTimeout = 30 * time.Second
+
+// QueryParams holds the parameters of a Query protocol action. Lists and
+// structures are flattened into names like MetricData.member.1.Value.
+type QueryParams map[string]string
+
+func (p QueryParams) Set(name string, value string) {
+	p[name] = value
+}
+
+func (p QueryParams) SetInt(name string, value int64) {
+	p[name] = strconv.FormatInt(value, 10)
+}
+
+func (p QueryParams) SetFloat(name string, value float64) {
+	p[name] = strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (p QueryParams) SetBool(name string, value bool) {
+	p[name] = strconv.FormatBool(value)
+}
+
+func (p QueryParams) SetTime(name string, value time.Time) {
+	p[name] = timeInRfc3339(value)
+}
+
+// Set the members of a list, e.g. Tags.member.1 and Tags.member.2 for
+// prefix Tags.member
+func (p QueryParams) SetList(prefix string, values []string) {
+	for i, v := range values {
+		p[fmt.Sprintf("%s.%d", prefix, i+1)] = v
+	}
+}
+
+// Form encoded parameters, sorted by name
+func (p QueryParams) Encode() string {
+	values := url.Values{}
+	for k, v := range p {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// QueryClient calls actions of an AWS service using the Query protocol.
+type QueryClient struct {
+	// URL requests are posted to, e.g. https://sqs.eu-west-1.amazonaws.com
+	// or the URL of an SQS queue
+	Endpoint string
+
+	// Signing name and region of the service, e.g. monitoring and eu-west-1.
+	// Derived from Endpoint if not set.
+	Service string
+	Region  string
+
+	// API version of the service, e.g. 2010-08-01
+	Version string
+
+	// Credentials to sign requests with. Requests are not signed if nil.
+	Credentials credentials.Provider
+
+	// Defaults to a client with a 30 second timeout
+	HTTPClient *http.Client
+
+	// Retries failed requests. Defaults to DefaultRetryer.
+	Retryer *Retryer
+
+	// Actions that can safely be retried after network errors that may have
+	// happened after AWS processed the request
+	IdempotentActions map[string]bool
+
+	// Corrects the signing time for a skewed local clock. Defaults to
+	// DefaultClockSkew.
+	ClockSkew *ClockSkew
+
+	// Channel the ClockSkew metric is sent to whenever the offset is
+	// corrected. Metrics are dropped rather than blocking requests, so the
+	// channel should be buffered.
+	Metrics chan<- stats.Metric
+}
+
+// Initialise a client for version of service in region, posting requests to
+// endpoint.
+func NewQueryClient(endpoint string, service string, region string, version string, credentials credentials.Provider) *QueryClient {
+	return &QueryClient{
+		Endpoint:    endpoint,
+		Service:     service,
+		Region:      region,
+		Version:     version,
+		Credentials: credentials,
+		HTTPClient:  &http.Client{Timeout: defaultQueryTimeout},
+	}
+}
+
+// Call action with params and decode the XML response into out, unless it is
+// nil. Failed requests are retried as decided by the Retryer. Returns an
+// *Error if the service could not process the request.
+func (c *QueryClient) Call(ctx context.Context, action string, params QueryParams, out interface{}) error {
+	form := QueryParams{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("Action", action)
+	form.Set("Version", c.Version)
+
+	endpoint := c.Endpoint
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("Invalid endpoint: %s", endpoint)
+	} else if u.Path == "" {
+		endpoint += "/"
+	}
+
+	retryer := c.Retryer
+	if retryer == nil {
+		retryer = DefaultRetryer
+	}
+	body := form.Encode()
+	return retryer.Do(ctx, c.IdempotentActions[action], func() error {
+		return c.do(ctx, action, endpoint, body, out)
+	})
+}
+
+func (c *QueryClient) clockSkew() *ClockSkew {
+	if c.ClockSkew == nil {
+		return DefaultClockSkew
+	}
+	return c.ClockSkew
+}
+
+// Send a single request
+func (c *QueryClient) do(ctx context.Context, action string, endpoint string, form string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	skew := c.clockSkew()
+	offset := skew.Offset()
+	if c.Credentials != nil {
+		if err := NewV4Signer(c.Credentials, c.Service, c.Region).signAt(req, time.Now().Add(offset)); err != nil {
+			return fmt.Errorf("Signing %s request failed: %v", action, err)
+		}
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		e := parseError(res, body)
+		e.clockSkewCorrected = skew.correct(res, e, offset)
+		if e.clockSkewCorrected {
+			skew.emitMetric(c.Metrics)
+		}
+		return fmt.Errorf("%s failed: %w", action, e)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("Decoding %s response failed: %v", action, err)
+	}
+	return nil
+}
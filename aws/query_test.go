@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testErrorResponse = `<ErrorResponse xmlns="http://queue.amazonaws.com/doc/2012-11-05/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>InvalidParameterValue</Code>
+    <Message>Value for parameter MessageBody is invalid.</Message>
+  </Error>
+  <RequestId>42d59b56-7407-4c4a-be0f-4c88daeea257</RequestId>
+</ErrorResponse>`
+
+type testResponse struct {
+	MessageId string `xml:"SendMessageResult>MessageId"`
+}
+
+func newTestQueryServer(t *testing.T, status int, body string) (*httptest.Server, *[]*http.Request) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests = append(requests, r)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestQueryCall(t *testing.T) {
+	server, requests := newTestQueryServer(t, http.StatusOK,
+		`<SendMessageResponse><SendMessageResult><MessageId>5fea7756</MessageId></SendMessageResult></SendMessageResponse>`)
+	c := NewQueryClient(server.URL+"/123456789012/queue", "sqs", "eu-west-1", "2012-11-05", credentials.NewIamUserCredentials("AKID", "SECRET"))
+
+	var res testResponse
+	params := QueryParams{"MessageBody": "hello world & more"}
+	params.SetInt("DelaySeconds", 5)
+	if err := c.Call(context.Background(), "SendMessage", params, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.MessageId != "5fea7756" {
+		t.Fatalf("Unexpected response: %+v", res)
+	}
+
+	req := (*requests)[0]
+	if req.Method != "POST" || req.URL.Path != "/123456789012/queue" {
+		t.Fatalf("Unexpected request: %s %s", req.Method, req.URL)
+	}
+	expected := url.Values{
+		"Action":       {"SendMessage"},
+		"Version":      {"2012-11-05"},
+		"MessageBody":  {"hello world & more"},
+		"DelaySeconds": {"5"},
+	}
+	if req.PostForm.Encode() != expected.Encode() {
+		t.Fatalf("Expected form %v, got %v", expected, req.PostForm)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "/eu-west-1/sqs/aws4_request") {
+		t.Fatalf("Expected request signed for sqs in eu-west-1, got %s", auth)
+	}
+}
+
+func TestQueryCallUnsigned(t *testing.T) {
+	server, requests := newTestQueryServer(t, http.StatusOK, "<Response/>")
+	c := NewQueryClient(server.URL, "sts", "us-east-1", "2011-06-15", nil)
+
+	if err := c.Call(context.Background(), "AssumeRoleWithWebIdentity", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	req := (*requests)[0]
+	if req.URL.Path != "/" || req.Header.Get("Authorization") != "" {
+		t.Fatalf("Expected unsigned request to /, got %s with %v", req.URL, req.Header)
+	}
+}
+
+func TestQueryCallError(t *testing.T) {
+	server, _ := newTestQueryServer(t, http.StatusBadRequest, testErrorResponse)
+	c := NewQueryClient(server.URL, "sqs", "eu-west-1", "2012-11-05", credentials.NewIamUserCredentials("AKID", "SECRET"))
+
+	err := c.Call(context.Background(), "SendMessage", QueryParams{}, nil)
+	var awsErr *Error
+	if !errors.As(err, &awsErr) {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if awsErr.Code != "InvalidParameterValue" || awsErr.StatusCode != 400 || awsErr.RequestId != "42d59b56-7407-4c4a-be0f-4c88daeea257" ||
+		awsErr.Message != "Value for parameter MessageBody is invalid." {
+		t.Fatalf("Unexpected error: %+v", awsErr)
+	}
+	if !strings.HasPrefix(err.Error(), "SendMessage failed: InvalidParameterValue") {
+		t.Fatalf("Unexpected error message: %s", err)
+	}
+
+	// Not an ErrorResponse document
+	server, _ = newTestQueryServer(t, http.StatusBadGateway, "Bad Gateway")
+	c.Endpoint = server.URL
+	err = c.Call(context.Background(), "SendMessage", QueryParams{}, nil)
+	if !errors.As(err, &awsErr) || awsErr.StatusCode != 502 || awsErr.Message != "Bad Gateway" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestQueryCallInvalidEndpoint(t *testing.T) {
+	c := NewQueryClient("sqs.eu-west-1.amazonaws.com", "sqs", "eu-west-1", "2012-11-05", nil)
+	if err := c.Call(context.Background(), "SendMessage", QueryParams{}, nil); err == nil {
+		t.Fatal("Expected error for endpoint without scheme")
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	params := QueryParams{}
+	params.SetFloat("Value", 0.25)
+	params.SetBool("Enabled", true)
+	params.SetTime("Timestamp", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	params.SetList("AttributeName.member", []string{"All", "Policy"})
+
+	expected := "AttributeName.member.1=All&AttributeName.member.2=Policy&Enabled=true&Timestamp=2020-01-02T03%3A04%3A05Z&Value=0.25"
+	if encoded := params.Encode(); encoded != expected {
+		t.Fatalf("Expected %s, got %s", expected, encoded)
+	}
+}
@@ -0,0 +1,236 @@
+// Retrying of failed requests to AWS services.
+//
+// Requests are retried with exponential backoff and full jitter when AWS
+// throttled them or failed to process them, and after network errors that
+// cannot have left the request half applied. A token bucket shared by all
+// requests of a Retryer stops retries once most requests fail, so that
+// retries do not make an outage worse.
+//
+// More info: http://docs.aws.amazon.com/sdkref/latest/guide/feature-retry-behavior.html
+package aws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 20 * time.Second
+	defaultRetryTokens    = 500
+	retryCost             = 5
+	timeoutRetryCost      = 10
+	noRetryIncrement      = 1
+)
+
+// DefaultRetryer is used by clients without a Retryer of their own.
+var DefaultRetryer = &Retryer{}
+
+// Retryer decides whether and when failed requests are retried. The zero
+// value uses the defaults. It is safe for concurrent use.
+type Retryer struct {
+	// Attempts per request, including the first one. Defaults to 3. Set to 1
+	// to disable retries.
+	MaxAttempts int
+
+	// Backoff before the nth retry is chosen at random between 0 and
+	// BaseDelay * 2^n, capped at MaxDelay. Default to 100 milliseconds and
+	// 20 seconds. MaxDelay also caps the delay requested by AWS with a
+	// Retry-After header.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Tokens spent on retries, refunded when they succeed. Defaults to a
+	// bucket of 500 tokens shared by all requests using the Retryer.
+	Tokens *RetryTokenBucket
+
+	once sync.Once
+}
+
+func (r *Retryer) init() {
+	r.once.Do(func() {
+		if r.Tokens == nil {
+			r.Tokens = NewRetryTokenBucket(defaultRetryTokens)
+		}
+	})
+}
+
+func (r *Retryer) maxAttempts() int {
+	if r.MaxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return r.MaxAttempts
+}
+
+// Backoff with full jitter before retry number retry, starting at 1
+func (r *Retryer) backoff(retry int) time.Duration {
+	base, max := r.BaseDelay, r.MaxDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if max <= 0 {
+		max = defaultRetryMaxDelay
+	}
+	ceiling := max
+	if retry < 32 && base<<uint(retry-1) < max {
+		ceiling = base << uint(retry-1)
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (r *Retryer) maxDelay() time.Duration {
+	if r.MaxDelay <= 0 {
+		return defaultRetryMaxDelay
+	}
+	return r.MaxDelay
+}
+
+// Run attempt until it succeeds, fails with an error that is not retryable
+// or the attempts or retry tokens are used up. Errors of requests that may
+// have been processed by AWS are only retried if idempotent is set.
+func (r *Retryer) Do(ctx context.Context, idempotent bool, attempt func() error) error {
+	r.init()
+	var spent int
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil {
+			if spent > 0 {
+				r.Tokens.Release(spent)
+			} else {
+				r.Tokens.Release(noRetryIncrement)
+			}
+			return nil
+		}
+
+		if n >= r.maxAttempts() || !ShouldRetry(err, idempotent) {
+			return err
+		}
+		cost := retryCost
+		if isTimeout(err) {
+			cost = timeoutRetryCost
+		}
+		if !r.Tokens.Acquire(cost) {
+			return err
+		}
+		spent = cost
+
+		delay := r.backoff(n)
+		var e *Error
+		if errors.As(err, &e) && e.RetryAfter > 0 {
+			delay = e.RetryAfter
+			if delay > r.maxDelay() {
+				delay = r.maxDelay()
+			}
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// Whether a request that failed with err may succeed when retried. AWS
+// errors are retried if IsRetryable says so, network errors if the request
+// never reached AWS or is idempotent.
+func ShouldRetry(err error, idempotent bool) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Retryable()
+	}
+
+	// Connection could not be established, so nothing was sent
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	// Request may have been processed before the connection failed
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return idempotent
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Delay requested with the Retry-After header of res, in seconds or as a
+// date, or 0 if there is none
+func retryAfter(res *http.Response) time.Duration {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// RetryTokenBucket limits retries once many requests fail. Every retry costs
+// tokens, which are refunded if it succeeds. Requests succeeding at the
+// first attempt add a token, up to the capacity.
+type RetryTokenBucket struct {
+	mu       sync.Mutex
+	capacity int
+	tokens   int
+}
+
+// Initialise a full bucket of capacity tokens
+func NewRetryTokenBucket(capacity int) *RetryTokenBucket {
+	return &RetryTokenBucket{capacity: capacity, tokens: capacity}
+}
+
+// Take cost tokens, returning false if not enough are left
+func (b *RetryTokenBucket) Acquire(cost int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+// Return n tokens, up to the capacity
+func (b *RetryTokenBucket) Release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += n
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+// Number of tokens left
+func (b *RetryTokenBucket) Available() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
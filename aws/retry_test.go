@@ -0,0 +1,209 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	errThrottled = fmt.Errorf("PutMetricData failed: %w", &Error{Code: "Throttling", StatusCode: 400})
+	errDenied    = fmt.Errorf("PutMetricData failed: %w", &Error{Code: "AccessDenied", StatusCode: 403})
+)
+
+// Retryer retrying without delay
+func newTestRetryer(attempts int) *Retryer {
+	return &Retryer{MaxAttempts: attempts, BaseDelay: time.Nanosecond, MaxDelay: time.Millisecond}
+}
+
+func TestRetryerDo(t *testing.T) {
+	r := newTestRetryer(3)
+	attempts := 0
+	err := r.Do(context.Background(), false, func() error {
+		attempts++
+		if attempts < 3 {
+			return errThrottled
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("Expected success after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	// Attempts used up
+	attempts = 0
+	err = r.Do(context.Background(), false, func() error {
+		attempts++
+		return errThrottled
+	})
+	if err != errThrottled || attempts != 3 {
+		t.Fatalf("Expected throttling error after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	// Not retryable
+	attempts = 0
+	err = r.Do(context.Background(), false, func() error {
+		attempts++
+		return errDenied
+	})
+	if err != errDenied || attempts != 1 {
+		t.Fatalf("Expected client error not to be retried, got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	r := &Retryer{MaxAttempts: 2, MaxDelay: 200 * time.Millisecond}
+	err := &Error{Code: "SlowDown", StatusCode: 503, RetryAfter: time.Hour}
+
+	begin := time.Now()
+	r.Do(context.Background(), false, func() error { return err })
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected Retry-After to be capped at 200ms, waited %s", elapsed)
+	}
+
+	res := &http.Response{Header: http.Header{"Retry-After": {"3"}}}
+	if d := retryAfter(res); d != 3*time.Second {
+		t.Fatalf("Expected 3s, got %s", d)
+	}
+	res.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d := retryAfter(res); d < 58*time.Second || d > time.Minute {
+		t.Fatalf("Expected about a minute, got %s", d)
+	}
+}
+
+func TestRetryerCancelled(t *testing.T) {
+	r := &Retryer{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	err := r.Do(ctx, false, func() error {
+		attempts++
+		return errThrottled
+	})
+	if err != errThrottled || attempts != 1 {
+		t.Fatalf("Expected to give up when the context is done, got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestRetryTokenBucket(t *testing.T) {
+	r := newTestRetryer(10)
+	r.Tokens = NewRetryTokenBucket(12)
+
+	attempts := 0
+	r.Do(context.Background(), false, func() error {
+		attempts++
+		return errThrottled
+	})
+	if attempts != 3 || r.Tokens.Available() != 2 {
+		t.Fatalf("Expected 2 retries costing 5 tokens each, got %d attempts and %d tokens left", attempts, r.Tokens.Available())
+	}
+
+	// Successful retries are refunded, first attempts add a token
+	r.Tokens = NewRetryTokenBucket(12)
+	attempts = 0
+	r.Do(context.Background(), false, func() error {
+		attempts++
+		if attempts == 1 {
+			return errThrottled
+		}
+		return nil
+	})
+	if r.Tokens.Available() != 12 {
+		t.Fatalf("Expected retry to be refunded, %d tokens left", r.Tokens.Available())
+	}
+	r.Tokens.Acquire(5)
+	r.Do(context.Background(), false, func() error { return nil })
+	if r.Tokens.Available() != 8 {
+		t.Fatalf("Expected success to add a token, %d tokens left", r.Tokens.Available())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := &Retryer{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, ceiling := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second, 100: time.Second} {
+		for i := 0; i < 100; i++ {
+			if d := r.backoff(retry); d < 0 || d > ceiling {
+				t.Fatalf("Expected backoff before retry %d of at most %s, got %s", retry, ceiling, d)
+			}
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	tests := []struct {
+		err        error
+		idempotent bool
+		expected   bool
+	}{
+		{errThrottled, false, true},
+		{errDenied, true, false},
+		{fmt.Errorf("Post: %w", dial), false, true},
+		{fmt.Errorf("Post: %w", read), false, false},
+		{fmt.Errorf("Post: %w", read), true, true},
+		{&net.DNSError{Err: "no such host", Name: "sqs.eu-west-1.amazonaws.com"}, false, true},
+		{context.Canceled, true, false},
+		{errors.New("Signing SendMessage request failed"), true, false},
+	}
+	for _, test := range tests {
+		if ShouldRetry(test.err, test.idempotent) != test.expected {
+			t.Fatalf("Expected ShouldRetry(%v, %t) to be %t", test.err, test.idempotent, test.expected)
+		}
+	}
+}
+
+func TestQueryCallRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("<Response/>"))
+	}))
+	defer server.Close()
+
+	c := NewQueryClient(server.URL, "monitoring", "eu-west-1", "2010-08-01", nil)
+	c.Retryer = newTestRetryer(3)
+	if err := c.Call(context.Background(), "PutMetricData", QueryParams{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("Expected 3 requests, got %d", n)
+	}
+}
+
+func TestQueryCallIdempotency(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// Drop the connection after receiving the request
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	c := NewQueryClient(server.URL, "sqs", "eu-west-1", "2012-11-05", nil)
+	c.Retryer = newTestRetryer(3)
+	if err := c.Call(context.Background(), "SendMessage", QueryParams{}, nil); err == nil {
+		t.Fatal("Expected error for dropped connection")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected SendMessage not to be retried, got %d requests", n)
+	}
+
+	c.IdempotentActions = map[string]bool{"GetQueueAttributes": true}
+	c.Call(context.Background(), "GetQueueAttributes", QueryParams{}, nil)
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Fatalf("Expected idempotent action to be retried, got %d requests", n-1)
+	}
+}
@@ -1,49 +1,341 @@
 package aws
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"sort"
 	"strings"
 	"time"
 )
 
-var b64 = base64.StdEncoding
+const (
+	v4Algorithm       = "AWS4-HMAC-SHA256"
+	v4TimeFormat      = "20060102T150405Z"
+	v4DateFormat      = "20060102"
+	v4ScopeTerminator = "aws4_request"
+	defaultRegion     = "us-east-1"
+)
 
-// Version 2 signing for AWS Requests (http://goo.gl/RSRp5)
-func sign(req *http.Request, keys *credentials.Credentials) {
+// V4Signer signs HTTP requests using AWS Signature Version 4
+// (http://docs.aws.amazon.com/general/latest/gr/signature-version-4.html).
+//
+// Region and Service are derived from the request host when left blank,
+// e.g. sqs.eu-west-1.amazonaws.com signs for region eu-west-1 and service sqs.
+// For other hosts, like LocalStack at http://localhost:4566, Service must be
+// set and Region defaults to us-east-1.
+type V4Signer struct {
+	// AWS Credentials
+	Credentials credentials.Provider
 
-	params := req.URL.Query()
+	// Region to sign for, e.g. eu-west-1
+	Region string
+
+	// Signing name of the service, e.g. monitoring or sqs
+	Service string
+}
+
+// NewV4Signer returns a V4Signer for a given service and region. Either may
+// be empty to have it derived from the request host.
+func NewV4Signer(creds credentials.Provider, service string, region string) *V4Signer {
+	return &V4Signer{creds, region, service}
+}
 
-	params.Set("AWSAccessKeyId", keys.AccessKeyId)
-	params.Set("SignatureVersion", "2")
-	params.Set("SignatureMethod", "HmacSHA256")
+// Sign adds the X-Amz-Date, X-Amz-Security-Token (for temporary credentials)
+// and Authorization headers to req. All headers already set on the request
+// are signed along with the host. The request body, if any, is read to
+// compute the payload hash and replaced with an equivalent reader. Returns an
+// error if no valid credentials can be retrieved within the request context.
+func (s *V4Signer) Sign(req *http.Request) error {
+	return s.signAt(req, time.Now())
+}
 
-	// Check if we are using temporary credentials
+// Presign adds the signature to the query string of req instead of its
+// headers, making the URL usable without further authentication until
+// expires has passed.
+func (s *V4Signer) Presign(req *http.Request, expires time.Duration) error {
+	return s.presignAt(req, expires, time.Now())
+}
+
+func (s *V4Signer) signAt(req *http.Request, t time.Time) error {
+	payloadHash, err := hashBody(req)
+	if err != nil {
+		return err
+	}
+	keys, err := s.Credentials.Retrieve(req.Context())
+	if err != nil {
+		return err
+	}
+	region, service, err := s.scope(req)
+	if err != nil {
+		return err
+	}
+	t = t.UTC()
+
+	req.Header.Set("X-Amz-Date", t.Format(v4TimeFormat))
 	if keys.Token != "" {
-		params.Set("SecurityToken", keys.Token)
+		req.Header.Set("X-Amz-Security-Token", keys.Token)
 	}
 
-	var sarray []string
-	for k, _ := range params {
-		sarray = append(sarray, url.QueryEscape(k)+"="+url.QueryEscape(params.Get(k)))
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	creq := canonicalRequest(req, canonicalQueryString(req.URL.Query()), canonicalHeaders, signedHeaders, payloadHash)
+	scope := credentialScope(t, region, service)
+	signature := v4Signature(keys.SecretAccessKey, t, region, service, stringToSign(t, scope, creq))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		v4Algorithm, keys.AccessKeyId, scope, signedHeaders, signature))
+	return nil
+}
+
+func (s *V4Signer) presignAt(req *http.Request, expires time.Duration, t time.Time) error {
+	keys, err := s.Credentials.Retrieve(req.Context())
+	if err != nil {
+		return err
+	}
+	region, service, err := s.scope(req)
+	if err != nil {
+		return err
 	}
-	sort.StringSlice(sarray).Sort()
-	joined := strings.Join(sarray, "&")
-	payload := req.Method + "\n" + req.Host + "\n" + req.URL.Path + "\n" + joined
-	// log.Print(payload)
-	hash := hmac.New(sha256.New, []byte(keys.SecretAccessKey))
-	hash.Write([]byte(payload))
-	signature := make([]byte, b64.EncodedLen(hash.Size()))
-	b64.Encode(signature, hash.Sum(nil))
+	t = t.UTC()
+	scope := credentialScope(t, region, service)
 
-	params.Set("Signature", string(signature))
+	params := req.URL.Query()
+	params.Set("X-Amz-Algorithm", v4Algorithm)
+	params.Set("X-Amz-Credential", keys.AccessKeyId+"/"+scope)
+	params.Set("X-Amz-Date", t.Format(v4TimeFormat))
+	params.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(expires/time.Second)))
+	if keys.Token != "" {
+		params.Set("X-Amz-Security-Token", keys.Token)
+	}
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	params.Set("X-Amz-SignedHeaders", signedHeaders)
+	query := canonicalQueryString(params)
+	creq := canonicalRequest(req, query, canonicalHeaders, signedHeaders, "UNSIGNED-PAYLOAD")
+	signature := v4Signature(keys.SecretAccessKey, t, region, service, stringToSign(t, scope, creq))
+
+	req.URL.RawQuery = query + "&X-Amz-Signature=" + signature
+	return nil
+}
+
+// Region and service to sign for, falling back to the values derived from
+// the request host. Returns an error if no service is set for a host the
+// service cannot be derived from.
+func (s *V4Signer) scope(req *http.Request) (region string, service string, err error) {
+	region, service = s.Region, s.Service
+	if region == "" || service == "" {
+		host := requestHost(req)
+		r, svc := deriveRegionAndService(host)
+		if region == "" {
+			region = r
+		}
+		if service == "" {
+			service = svc
+		}
+		if service == "" {
+			return "", "", fmt.Errorf("Service must be set to sign requests to %s", host)
+		}
+	}
+	return
+}
+
+// Domains of AWS endpoints, which regions and services can be derived from
+var awsDomains = []string{".amazonaws.com", ".amazonaws.com.cn", ".api.aws", ".amazonwebservices.com.cn"}
+
+// Derive region and signing name from an AWS endpoint host such as
+// monitoring.eu-west-1.amazonaws.com. Global endpoints like
+// monitoring.amazonaws.com sign for us-east-1. For other hosts, e.g. IP
+// addresses or localhost, the service is left blank.
+func deriveRegionAndService(host string) (region string, service string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !isAwsHost(host) {
+		return defaultRegion, ""
+	}
+	labels := strings.Split(host, ".")
+	// FIPS endpoints sign for the plain service, e.g. sqs-fips.us-gov-west-1.amazonaws.com
+	region, service = defaultRegion, strings.TrimSuffix(labels[0], "-fips")
+	if service == "queue" {
+		// Legacy SQS endpoint, e.g. eu-west-1.queue.amazonaws.com
+		service = "sqs"
+	}
+	if len(labels) > 1 && labels[1] != "amazonaws" {
+		if labels[1] == "queue" {
+			service, region = "sqs", labels[0]
+		} else {
+			region = labels[1]
+		}
+	}
+	return
+}
 
-	req.URL.RawQuery = params.Encode()
+func isAwsHost(host string) bool {
+	for _, domain := range awsDomains {
+		if strings.HasSuffix(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// Hash the request body and restore it so it can still be sent.
+func hashBody(req *http.Request) (string, error) {
+	if req.Body == nil {
+		return hexSha256(nil), nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("Cannot read request body for signing: %v", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return hexSha256(body), nil
+}
+
+func canonicalRequest(req *http.Request, query string, headers string, signedHeaders string, payloadHash string) string {
+	return strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		query,
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+// Normalized, URI-encoded path of the request. Empty paths become "/".
+func canonicalURI(u *url.URL) string {
+	p := u.Path
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean(p)
+	if cleaned != "/" && strings.HasSuffix(p, "/") {
+		cleaned += "/"
+	}
+	segments := strings.Split(cleaned, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Query parameters sorted by name and value, with names and values
+// URI-encoded.
+func canonicalQueryString(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	encoded := make(map[string][]string, len(params))
+	for k, vs := range params {
+		ek := uriEncode(k)
+		keys = append(keys, ek)
+		for _, v := range vs {
+			encoded[ek] = append(encoded[ek], uriEncode(v))
+		}
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		sort.Strings(encoded[k])
+		for _, v := range encoded[k] {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Canonical header block and the list of signed header names. Header values
+// are trimmed and sequential spaces collapsed to one.
+func canonicalHeaders(req *http.Request) (signed string, canonical string) {
+	headers := map[string][]string{"host": {requestHost(req)}}
+	for k, vs := range req.Header {
+		name := strings.ToLower(k)
+		if name == "authorization" || name == "user-agent" {
+			continue
+		}
+		headers[name] = append(headers[name], vs...)
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		values := make([]string, len(headers[name]))
+		for i, v := range headers[name] {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		buf.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return strings.Join(names, ";"), buf.String()
+}
+
+func credentialScope(t time.Time, region string, service string) string {
+	return strings.Join([]string{t.Format(v4DateFormat), region, service, v4ScopeTerminator}, "/")
+}
+
+func stringToSign(t time.Time, scope string, canonicalRequest string) string {
+	return strings.Join([]string{
+		v4Algorithm,
+		t.Format(v4TimeFormat),
+		scope,
+		hexSha256([]byte(canonicalRequest)),
+	}, "\n")
+}
+
+// Derive the signing key from the secret key and sign stringToSign with it.
+func v4Signature(secretKey string, t time.Time, region string, service string, stringToSign string) string {
+	key := hmacSha256([]byte("AWS4"+secretKey), t.Format(v4DateFormat))
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, service)
+	key = hmacSha256(key, v4ScopeTerminator)
+	return hex.EncodeToString(hmacSha256(key, stringToSign))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
+
+func hexSha256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// URI-encode every byte except the unreserved characters A-Z, a-z, 0-9,
+// '-', '.', '_' and '~', as required by Signature Version 4.
+func uriEncode(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
 }
 
 // Convert time to RFC 3339 format
@@ -0,0 +1,168 @@
+package aws
+
+import (
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Requests and expected signatures from the AWS Signature Version 4 test
+// suite: http://docs.aws.amazon.com/general/latest/gr/signature-v4-test-suite.html
+var v4TestSuite = []struct {
+	name      string
+	method    string
+	uri       string
+	headers   map[string]string
+	body      string
+	signed    string
+	signature string
+}{
+	{"get-vanilla", "GET", "/", nil, "",
+		"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{"get-vanilla-empty-query-key", "GET", "/?Param1=value1", nil, "",
+		"host;x-amz-date", "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb"},
+	{"get-vanilla-query-order-key-case", "GET", "/?Param2=value2&Param1=value1", nil, "",
+		"host;x-amz-date", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	{"get-vanilla-query-unreserved", "GET", "/?-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz", nil, "",
+		"host;x-amz-date", "9c3e54bfcdf0b19771a7f523ee5669cdf59bc7cc0884027167c21bb143a40197"},
+	{"get-vanilla-utf8-query", "GET", "/?ሴ=bar", nil, "",
+		"host;x-amz-date", "2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04"},
+	{"get-utf8", "GET", "/ሴ", nil, "",
+		"host;x-amz-date", "8318018e0b0f223aa2bbf98705b62bb787dc9c0e678f255a891fd03141be5d85"},
+	{"get-slash", "GET", "//", nil, "",
+		"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{"get-slash-dot-slash", "GET", "/./", nil, "",
+		"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{"get-relative", "GET", "/example/..", nil, "",
+		"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{"get-relative-relative", "GET", "/example1/example2/../..", nil, "",
+		"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+	{"get-slashes", "GET", "//example//", nil, "",
+		"host;x-amz-date", "9a624bd73a37c9a373b5312afbebe7a714a789de108f0bdfe846570885f57e84"},
+	{"get-header-value-trim", "GET", "/", map[string]string{"My-Header1": " value1", "My-Header2": ` "a   b   c"`}, "",
+		"host;my-header1;my-header2;x-amz-date", "acc3ed3afb60bb290fc8d2dd0098b9911fcaa05412b367055dee359757a9c736"},
+	{"post-vanilla", "POST", "/", nil, "",
+		"host;x-amz-date", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	{"post-vanilla-query", "POST", "/?Param1=value1", nil, "",
+		"host;x-amz-date", "28038455d6de14eafc1f9222cf5aa6f1a96197d7deb8263271d420d138af7f11"},
+	{"post-header-key-sort", "POST", "/", map[string]string{"My-Header1": "value1"}, "",
+		"host;my-header1;x-amz-date", "c5410059b04c1ee005303aed430f6e6645f61f4dc9e1461ec8f8916fdf18852c"},
+	{"post-header-value-case", "POST", "/", map[string]string{"My-Header1": "VALUE1"}, "",
+		"host;my-header1;x-amz-date", "cdbc9802e29d2942e5e10b5bccfdd67c5f22c7c4e8ae67b53629efa58b974b7d"},
+	{"post-x-www-form-urlencoded", "POST", "/", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "Param1=value1",
+		"content-type;host;x-amz-date", "ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"},
+}
+
+var (
+	testSuiteCredentials = credentials.NewIamUserCredentials("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	testSuiteTime        = time.Date(2015, time.August, 30, 12, 36, 0, 0, time.UTC)
+)
+
+func TestV4TestSuite(t *testing.T) {
+	signer := NewV4Signer(testSuiteCredentials, "service", "us-east-1")
+
+	for _, tc := range v4TestSuite {
+		req, err := http.NewRequest(tc.method, "https://example.amazonaws.com"+tc.uri, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+
+		if err := signer.signAt(req, testSuiteTime); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=" + tc.signed + ", Signature=" + tc.signature
+		if auth := req.Header.Get("Authorization"); auth != expected {
+			t.Errorf("%s: expected Authorization\n%s\ngot\n%s", tc.name, expected, auth)
+		}
+	}
+}
+
+func TestV4SignTemporaryCredentials(t *testing.T) {
+	creds := &credentials.Credentials{AccessKeyId: "AKIDEXAMPLE", SecretAccessKey: "secret", Token: "session-token"}
+	req, _ := http.NewRequest("GET", "https://sqs.eu-west-1.amazonaws.com/123456789012/queue", nil)
+	NewV4Signer(creds, "", "").signAt(req, testSuiteTime)
+
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "session-token" {
+		t.Fatalf("Expected security token header to be set, got '%s'", token)
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.Contains(auth, "/20150830/eu-west-1/sqs/aws4_request") {
+		t.Fatalf("Expected credential scope for eu-west-1/sqs, got %s", auth)
+	}
+	if !strings.Contains(auth, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Fatalf("Expected security token to be signed, got %s", auth)
+	}
+}
+
+func TestV4Presign(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/?Param1=value1", nil)
+	NewV4Signer(testSuiteCredentials, "service", "us-east-1").presignAt(req, 5*time.Minute, testSuiteTime)
+
+	params := req.URL.Query()
+	expected := map[string]string{
+		"Param1":              "value1",
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    "AKIDEXAMPLE/20150830/us-east-1/service/aws4_request",
+		"X-Amz-Date":          "20150830T123600Z",
+		"X-Amz-Expires":       "300",
+		"X-Amz-SignedHeaders": "host",
+	}
+	for k, v := range expected {
+		if params.Get(k) != v {
+			t.Errorf("Expected query parameter %s to be '%s', got '%s'", k, v, params.Get(k))
+		}
+	}
+	if len(params.Get("X-Amz-Signature")) != 64 {
+		t.Fatalf("Expected hex encoded signature, got '%s'", params.Get("X-Amz-Signature"))
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Fatal("Presigned request should not carry an Authorization header")
+	}
+}
+
+func TestDeriveRegionAndService(t *testing.T) {
+	cases := []struct{ host, region, service string }{
+		{"monitoring.amazonaws.com", "us-east-1", "monitoring"},
+		{"monitoring.eu-west-1.amazonaws.com", "eu-west-1", "monitoring"},
+		{"sqs.ap-southeast-2.amazonaws.com:443", "ap-southeast-2", "sqs"},
+		{"queue.amazonaws.com", "us-east-1", "sqs"},
+		{"eu-west-1.queue.amazonaws.com", "eu-west-1", "sqs"},
+		{"monitoring.cn-north-1.amazonaws.com.cn", "cn-north-1", "monitoring"},
+		{"sqs.eu-west-1.api.aws", "eu-west-1", "sqs"},
+		{"monitoring.cn-north-1.api.amazonwebservices.com.cn", "cn-north-1", "monitoring"},
+		{"sqs-fips.us-gov-west-1.amazonaws.com", "us-gov-west-1", "sqs"},
+		{"monitoring-fips.us-east-2.amazonaws.com:443", "us-east-2", "monitoring"},
+		{"127.0.0.1:4566", "us-east-1", ""},
+		{"localhost:4566", "us-east-1", ""},
+		{"[::1]:4566", "us-east-1", ""},
+	}
+
+	for _, c := range cases {
+		region, service := deriveRegionAndService(c.host)
+		if region != c.region || service != c.service {
+			t.Errorf("%s: expected %s/%s, got %s/%s", c.host, c.region, c.service, region, service)
+		}
+	}
+}
+
+func TestSignWithoutService(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:4566/", nil)
+	if err := NewV4Signer(credentials.NewIamUserCredentials("AKID", "SECRET"), "", "").Sign(req); err == nil {
+		t.Fatal("Expected error without service for non-AWS host")
+	}
+
+	req, _ = http.NewRequest("POST", "http://127.0.0.1:4566/", nil)
+	if err := NewV4Signer(credentials.NewIamUserCredentials("AKID", "SECRET"), "sqs", "").Sign(req); err != nil {
+		t.Fatal(err)
+	}
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "/us-east-1/sqs/aws4_request") {
+		t.Fatalf("Expected request signed for sqs in us-east-1, got %s", auth)
+	}
+}
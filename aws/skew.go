@@ -0,0 +1,95 @@
+// Correction of a skewed local clock when signing requests.
+//
+// AWS rejects requests whose signing time is more than a few minutes off.
+// When a request is rejected for that reason, the offset of the local clock
+// is measured from the Date header of the response and added to the signing
+// time of later requests, so that clients recover from a drifting clock.
+package aws
+
+import (
+	"github.com/soundcloud/sc-gaws/stats"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Name of the metric for the measured offset, in seconds
+	ClockSkewMetric = "ClockSkew"
+
+	// Smaller offsets cannot be measured reliably, as the Date header only
+	// has second precision
+	minClockSkew = 5 * time.Second
+)
+
+// Error codes of requests rejected because of their signing time
+var clockSkewErrorCodes = map[string]bool{
+	"RequestExpired":            true,
+	"RequestTimeTooSkewed":      true,
+	"RequestInTheFuture":        true,
+	"SignatureDoesNotMatch":     true,
+	"InvalidSignatureException": true,
+}
+
+// DefaultClockSkew is used by clients without a ClockSkew of their own.
+// Set Metrics of a client to be sent its metric on every correction, or
+// poll DefaultClockSkew.Metric() to report the offset periodically.
+var DefaultClockSkew = &ClockSkew{}
+
+// ClockSkew holds the offset between the clock of AWS and the local clock.
+// The zero value assumes both are in sync. It is safe for concurrent use.
+type ClockSkew struct {
+	offset int64
+}
+
+// Offset to add to the local time to get the time of AWS
+func (s *ClockSkew) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.offset))
+}
+
+// Current time of AWS
+func (s *ClockSkew) Now() time.Time {
+	return time.Now().Add(s.Offset())
+}
+
+// Metric of the current offset, e.g. to alert on hosts with drifting clocks
+func (s *ClockSkew) Metric() stats.Metric {
+	return stats.Metric{Name: ClockSkewMetric, Value: float32(s.Offset().Seconds()), Unit: "Seconds", Timestamp: time.Now()}
+}
+
+// Send the metric of the current offset to metrics without blocking, unless
+// it is nil
+func (s *ClockSkew) emitMetric(metrics chan<- stats.Metric) {
+	if metrics == nil {
+		return
+	}
+	m := s.Metric()
+	select {
+	case metrics <- m:
+	default:
+		log.Printf("Dropped metric %s, metrics channel is full", m.Name)
+	}
+}
+
+// Measure the offset from the response to a request signed with offset
+// signed, if it was rejected because of its signing time. Returns whether
+// the offset was corrected, so that the request may succeed when retried.
+func (s *ClockSkew) correct(res *http.Response, e *Error, signed time.Duration) bool {
+	if !clockSkewErrorCodes[e.Code] {
+		return false
+	}
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return false
+	}
+	offset := date.Sub(time.Now()).Round(time.Second)
+	if diff := offset - signed; diff > -minClockSkew && diff < minClockSkew {
+		// The request was signed with the correct time, e.g. the
+		// signature is wrong for other reasons
+		return false
+	}
+	atomic.StoreInt64(&s.offset, int64(offset))
+	log.Printf("Request failed with %s, correcting clock skew to %s", e.Code, offset)
+	return true
+}
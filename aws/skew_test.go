@@ -0,0 +1,127 @@
+package aws
+
+import (
+	"context"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"github.com/soundcloud/sc-gaws/stats"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testSkewedResponse = `<ErrorResponse>
+  <Error>
+    <Type>Sender</Type>
+    <Code>RequestTimeTooSkewed</Code>
+    <Message>The difference between the request time and the current time is too large.</Message>
+  </Error>
+</ErrorResponse>`
+
+// Server whose clock is ahead by offset, rejecting requests signed more than
+// 5 minutes off
+func newSkewedServer(t *testing.T, offset time.Duration) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		now := time.Now().Add(offset)
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		signed, err := time.Parse(v4TimeFormat, r.Header.Get("X-Amz-Date"))
+		if err != nil || signed.Sub(now) > 5*time.Minute || now.Sub(signed) > 5*time.Minute {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(testSkewedResponse))
+			return
+		}
+		w.Write([]byte("<Response/>"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestClockSkewCorrection(t *testing.T) {
+	server, requests := newSkewedServer(t, time.Hour)
+	c := NewQueryClient(server.URL, "monitoring", "eu-west-1", "2010-08-01", credentials.NewIamUserCredentials("AKID", "SECRET"))
+	c.Retryer = newTestRetryer(3)
+	c.ClockSkew = &ClockSkew{}
+	metrics := make(chan stats.Metric, 1)
+	c.Metrics = metrics
+
+	if err := c.Call(context.Background(), "PutMetricData", QueryParams{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-metrics:
+		if m.Name != ClockSkewMetric || m.Value < 3590 || m.Value > 3610 {
+			t.Fatalf("Unexpected metric: %+v", m)
+		}
+	default:
+		t.Fatal("Expected metric of the correction")
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("Expected request to be retried once, got %d requests", n)
+	}
+	if offset := c.ClockSkew.Offset(); offset < 59*time.Minute || offset > 61*time.Minute {
+		t.Fatalf("Expected clock skew of an hour, got %s", offset)
+	}
+	if m := c.ClockSkew.Metric(); m.Name != ClockSkewMetric || m.Value < 3590 || m.Value > 3610 {
+		t.Fatalf("Unexpected metric: %+v", m)
+	}
+
+	// Later requests are signed with the corrected time
+	if err := c.Call(context.Background(), "PutMetricData", QueryParams{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("Expected no retry after correction, got %d requests", n-2)
+	}
+	if len(metrics) != 0 {
+		t.Fatal("Expected no metric without correction")
+	}
+}
+
+func TestClockSkewCorrect(t *testing.T) {
+	res := &http.Response{Header: http.Header{"Date": {time.Now().Add(-10 * time.Minute).UTC().Format(http.TimeFormat)}}}
+	s := &ClockSkew{}
+
+	if s.correct(res, &Error{Code: "AccessDenied"}, 0) {
+		t.Fatal("Expected other errors to be ignored")
+	}
+	if !s.correct(res, &Error{Code: "SignatureDoesNotMatch"}, 0) {
+		t.Fatal("Expected clock skew to be corrected")
+	}
+	if offset := s.Offset(); offset < -11*time.Minute || offset > -9*time.Minute {
+		t.Fatalf("Expected offset of -10 minutes, got %s", offset)
+	}
+
+	// Signed with the correct time already, e.g. by a concurrent request
+	if s.correct(res, &Error{Code: "SignatureDoesNotMatch"}, s.Offset()) {
+		t.Fatal("Expected request signed with the measured offset not to be corrected")
+	}
+	res.Header.Del("Date")
+	if s.correct(res, &Error{Code: "RequestExpired"}, 0) {
+		t.Fatal("Expected no correction without a Date header")
+	}
+}
+
+func TestSkewNotRetriedWhenInSync(t *testing.T) {
+	server, requests := newTestQueryServer(t, http.StatusForbidden, testSkewedResponse)
+	c := NewQueryClient(server.URL, "monitoring", "eu-west-1", "2010-08-01", credentials.NewIamUserCredentials("AKID", "SECRET"))
+	c.Retryer = newTestRetryer(3)
+	c.ClockSkew = &ClockSkew{}
+
+	err := c.Call(context.Background(), "PutMetricData", QueryParams{}, nil)
+	if !IsClientError(err) || len(*requests) != 1 {
+		t.Fatalf("Expected client error without retries, got %v after %d requests", err, len(*requests))
+	}
+}
+
+func TestMetricTimestampsCorrected(t *testing.T) {
+	params := QueryParams{}
+	ts := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	marshalMetrics(params, []stats.Metric{{Name: "Requests", Value: 1, Timestamp: ts}}, -time.Hour)
+
+	if v := params["MetricData.member.1.Timestamp"]; v != "2017-03-01T11:00:00Z" {
+		t.Fatalf("Expected corrected timestamp, got %s", v)
+	}
+}
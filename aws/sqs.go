@@ -1,57 +1,83 @@
-// Types and functions to push metrics to AWS Cloudwatch
+// Client to publish messages to an AWS SQS queue
 package aws
 
 import (
+	"context"
 	"fmt"
 	"github.com/soundcloud/sc-gaws/aws/credentials"
-	"io/ioutil"
+	"github.com/soundcloud/sc-gaws/stats"
 	"net/http"
 	"net/url"
-	"time"
 	"unicode/utf8"
 )
 
 const (
-	sqsApiVersion = "2012-11-05"
+	sqsService       = "sqs"
+	sqsApiVersion    = "2012-11-05"
 	maxMessageLength = 8000
 )
 
-// AwsStatsPusher implements the StatsPusher interface to allow
-// pushing metrics to AWS Cloudwatch
+// SqsClient publishes messages to the SQS queue at Endpoint
 type SqsClient struct {
+	// URL of the queue, e.g. https://sqs.eu-west-1.amazonaws.com/123456789012/my-queue
 	Endpoint string
 
-	// AWS Credentials
-	Credentials credentials.CredentialsProvider
+	// Region of the queue. Derived from Endpoint if not set.
+	Region string
+
+	// AWS Credentials. Wrap implementations of the deprecated
+	// credentials.CredentialsProvider with credentials.NewProviderAdapter.
+	Credentials credentials.Provider
+
+	// Retries failed requests. Defaults to DefaultRetryer. Messages are not
+	// resent after network errors that may have happened after SQS received
+	// them, to avoid publishing them twice.
+	Retryer *Retryer
+
+	// Channel the ClockSkew metric is sent to whenever the signing time is
+	// corrected for a skewed local clock. Should be buffered.
+	Metrics chan<- stats.Metric
 
 	client *http.Client
 }
 
-func NewSqsClient(endpoint string, credentials credentials.CredentialsProvider) *SqsClient {
-	return &SqsClient{endpoint, credentials, &http.Client{}}
+func NewSqsClient(endpoint string, credentials credentials.Provider) *SqsClient {
+	return &SqsClient{Endpoint: endpoint, Credentials: credentials, client: &http.Client{}}
+}
+
+// Initialise a client for the queue named queueName of account accountId in
+// region, resolving the SQS endpoint with resolver, or the
+// DefaultEndpointResolver if nil.
+func NewSqsQueueClient(resolver *EndpointResolver, region string, accountId string, queueName string, credentials credentials.Provider) (*SqsClient, error) {
+	if resolver == nil {
+		resolver = DefaultEndpointResolver
+	}
+	if region == "" {
+		region = defaultRegion
+	}
+	endpoint, err := resolver.Resolve(sqsService, region)
+	if err != nil {
+		return nil, err
+	}
+	endpoint = fmt.Sprintf("%s/%s/%s", endpoint, accountId, url.PathEscape(queueName))
+	return &SqsClient{Endpoint: endpoint, Region: region, Credentials: credentials, client: &http.Client{}}, nil
 }
 
 func (s SqsClient) Publish(message string) error {
 
 	len := utf8.RuneCountInString(message)
 	if len > maxMessageLength {
-		return fmt.Errorf("Message is too long (%d chars), maximum is %d chars.", len, maxMessageLength)	
+		return fmt.Errorf("Message is too long (%d chars), maximum is %d chars.", len, maxMessageLength)
 	}
 
-	encodedMsg := url.QueryEscape(url.QueryEscape(message)) // SH: Message payload needs to be encoded twice or else spaces in message break signature method
-	urlStr := fmt.Sprintf("%s/?Action=SendMessage&Version=%s&Timestamp=%s&MessageBody=%s", s.Endpoint, sqsApiVersion, url.QueryEscape(timeInRfc3339(time.Now())), encodedMsg)
-	req, _ := http.NewRequest("GET", urlStr, nil)
-	sign(req, s.Credentials.GetCredentials())
-	res, err := s.client.Do(req)
-	
-	if err != nil {
-		return err
-	} else {
-		defer res.Body.Close()
-		if res.StatusCode != 200 {
-			body, _ := ioutil.ReadAll(res.Body)
-			return fmt.Errorf("Publishing message failed with status code %d: %s", res.StatusCode, body)
-		}
+	client := NewQueryClient(s.Endpoint, sqsService, s.Region, sqsApiVersion, s.Credentials)
+	client.Retryer = s.Retryer
+	client.Metrics = s.Metrics
+	if s.client != nil {
+		client.HTTPClient = s.client
+	}
+	if err := client.Call(context.Background(), "SendMessage", QueryParams{"MessageBody": message}, nil); err != nil {
+		return fmt.Errorf("Publishing message failed: %w", err)
 	}
 	return nil
 }
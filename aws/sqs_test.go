@@ -1,7 +1,9 @@
 package aws
 
 import (
+	"errors"
 	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"net/http"
 	"os"
 	"testing"
 )
@@ -25,3 +27,28 @@ func TestPublish(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 }
+
+func TestPublishToEndpoint(t *testing.T) {
+	server, requests := newTestQueryServer(t, http.StatusOK, "<SendMessageResponse/>")
+	c, err := NewSqsQueueClient(&EndpointResolver{Overrides: map[string]string{"sqs": server.URL}}, "eu-west-1", "123456789012", "my-queue",
+		credentials.NewIamUserCredentials("AKID", "SECRET"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Publish("Test a message with spaces"); err != nil {
+		t.Fatal(err)
+	}
+	req := (*requests)[0]
+	if req.URL.Path != "/123456789012/my-queue" || req.PostForm.Get("MessageBody") != "Test a message with spaces" {
+		t.Fatalf("Unexpected request: %s %v", req.URL, req.PostForm)
+	}
+
+	server, _ = newTestQueryServer(t, http.StatusBadRequest, testErrorResponse)
+	c.Endpoint = server.URL
+	err = c.Publish("Test")
+	var awsErr *Error
+	if !errors.As(err, &awsErr) || awsErr.Code != "InvalidParameterValue" {
+		t.Fatalf("Expected InvalidParameterValue error, got %v", err)
+	}
+}
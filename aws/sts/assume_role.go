@@ -0,0 +1,96 @@
+package sts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"sort"
+	"time"
+)
+
+// AssumeRoleOptions configures the role to assume and the session to create.
+type AssumeRoleOptions struct {
+	// ARN of the role to assume, e.g. arn:aws:iam::123456789012:role/audio-reader
+	RoleArn string
+
+	// Name identifying the session. Defaults to a unique sc-gaws-* name.
+	RoleSessionName string
+
+	// External ID required by the role's trust policy, if any
+	ExternalId string
+
+	// Lifetime of the credentials, between 15 minutes and the role's maximum
+	// session duration. Defaults to 1 hour.
+	Duration time.Duration
+
+	// Inline session policy further restricting the role's permissions
+	Policy string
+
+	// Session tags passed to the role
+	Tags map[string]string
+
+	// STS endpoint and region to sign for. The regional endpoint is used if
+	// only Region is set, the global endpoint if neither is. The region is
+	// derived from the host if only Endpoint is set.
+	Endpoint string
+	Region   string
+
+	// How the credentials are renewed
+	Refresh credentials.RefreshOptions
+}
+
+type assumeRoleResponse struct {
+	Credentials stsCredentials `xml:"AssumeRoleResult>Credentials"`
+}
+
+// Initialise temporary credentials for a role assumed using the credentials
+// of source. The credentials are renewed by assuming the role again before
+// they expire. Returns an error if the role could not be assumed.
+func NewAssumeRoleCredentials(source credentials.Provider, opts AssumeRoleOptions) (*credentials.RefreshingCredentials, error) {
+	if opts.RoleArn == "" {
+		return nil, errors.New("RoleArn must be set to assume a role")
+	}
+	if opts.RoleSessionName == "" {
+		opts.RoleSessionName = defaultSessionName()
+	}
+	c, err := newClient(opts.Endpoint, opts.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewRefreshingCredentialsWithOptions(func(ctx context.Context) (credentials.Credentials, error) {
+		var res assumeRoleResponse
+		if err := c.call(ctx, "AssumeRole", assumeRoleParams(opts), source, &res); err != nil {
+			return credentials.Credentials{}, err
+		}
+		return res.Credentials.credentials(), nil
+	}, opts.Refresh)
+}
+
+func assumeRoleParams(opts AssumeRoleOptions) aws.QueryParams {
+	params := aws.QueryParams{}
+	params.Set("RoleArn", opts.RoleArn)
+	params.Set("RoleSessionName", opts.RoleSessionName)
+	if opts.ExternalId != "" {
+		params.Set("ExternalId", opts.ExternalId)
+	}
+	if opts.Duration > 0 {
+		params.SetInt("DurationSeconds", int64(opts.Duration/time.Second))
+	}
+	if opts.Policy != "" {
+		params.Set("Policy", opts.Policy)
+	}
+
+	keys := make([]string, 0, len(opts.Tags))
+	for k := range opts.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		params.Set(fmt.Sprintf("Tags.member.%d.Key", i+1), k)
+		params.Set(fmt.Sprintf("Tags.member.%d.Value", i+1), opts.Tags[k])
+	}
+	return params
+}
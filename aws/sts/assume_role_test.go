@@ -0,0 +1,206 @@
+package sts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Response to AssumeRole and AssumeRoleWithWebIdentity, formatted with the
+// action name, a sequence number and the expiry time.
+const assumeRoleResponseXml = `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%[1]sResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE%[2]d</AccessKeyId>
+      <SecretAccessKey>SECRET</SecretAccessKey>
+      <SessionToken>TOKEN</SessionToken>
+      <Expiration>%[3]s</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/audio-reader/session</Arn>
+      <AssumedRoleId>AROAEXAMPLE:session</AssumedRoleId>
+    </AssumedRoleUser>
+  </%[1]sResult>
+  <ResponseMetadata>
+    <RequestId>c6104cbe-af31-11e0-8154-cbc7ccf896c7</RequestId>
+  </ResponseMetadata>
+</%[1]sResponse>`
+
+const errorResponseXml = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>AccessDenied</Code>
+    <Message>Not authorized to perform sts:AssumeRole</Message>
+  </Error>
+  <RequestId>f9a2e2a6-5b5b-11e0-8bb8-3b3b3b3b3b3b</RequestId>
+</ErrorResponse>`
+
+// Stand-in for STS recording the requests it receives
+type fakeSTS struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	deny     bool
+	requests []*http.Request
+	forms    []url.Values
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r.ParseForm()
+	f.requests = append(f.requests, r)
+	f.forms = append(f.forms, r.PostForm)
+	if f.deny {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, errorResponseXml)
+		return
+	}
+	fmt.Fprintf(w, assumeRoleResponseXml, r.PostForm.Get("Action"), len(f.requests), time.Now().Add(f.ttl).UTC().Format(time.RFC3339Nano))
+}
+
+func (f *fakeSTS) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// Lifetime of credentials in tests waiting for them to be renewed, which
+// happens halfway through it
+const shortLifetime = 200 * time.Millisecond
+
+// Hooks signalling renewals to tests waiting for them. Renewals nobody waits
+// for are not signalled, so that the refresher is never blocked.
+type refreshSignal struct {
+	credentials.NopHooks
+	refreshed chan credentials.Credentials
+}
+
+func newRefreshSignal() *refreshSignal {
+	return &refreshSignal{refreshed: make(chan credentials.Credentials)}
+}
+
+func (s *refreshSignal) RefreshSucceeded(creds credentials.Credentials) {
+	select {
+	case s.refreshed <- creds:
+	default:
+	}
+}
+
+// Wait for the next renewal
+func (s *refreshSignal) wait(t *testing.T) credentials.Credentials {
+	select {
+	case creds := <-s.refreshed:
+		return creds
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected credentials to be renewed")
+		return credentials.Credentials{}
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	f := &fakeSTS{ttl: time.Hour}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	source := credentials.NewIamUserCredentials("AKIDSOURCE", "SECRET")
+	provider, err := NewAssumeRoleCredentials(source, AssumeRoleOptions{
+		RoleArn:         "arn:aws:iam::123456789012:role/audio-reader",
+		RoleSessionName: "test-session",
+		ExternalId:      "shared-secret",
+		Duration:        15 * time.Minute,
+		Policy:          `{"Version":"2012-10-17"}`,
+		Tags:            map[string]string{"team": "audio", "env": "test"},
+		Endpoint:        server.URL,
+		Region:          "eu-west-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := retrieve(t, provider)
+	if creds.AccessKeyId != "ASIAEXAMPLE1" || creds.SecretAccessKey != "SECRET" || creds.Token != "TOKEN" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	expected := map[string]string{
+		"Action":              "AssumeRole",
+		"Version":             "2011-06-15",
+		"RoleArn":             "arn:aws:iam::123456789012:role/audio-reader",
+		"RoleSessionName":     "test-session",
+		"ExternalId":          "shared-secret",
+		"DurationSeconds":     "900",
+		"Policy":              `{"Version":"2012-10-17"}`,
+		"Tags.member.1.Key":   "env",
+		"Tags.member.1.Value": "test",
+		"Tags.member.2.Key":   "team",
+		"Tags.member.2.Value": "audio",
+	}
+	form := f.forms[0]
+	for k, v := range expected {
+		if form.Get(k) != v {
+			t.Errorf("Expected parameter %s to be '%s', got '%s'", k, v, form.Get(k))
+		}
+	}
+
+	auth := f.requests[0].Header.Get("Authorization")
+	if !strings.Contains(auth, "Credential=AKIDSOURCE/") || !strings.Contains(auth, "/eu-west-1/sts/aws4_request") {
+		t.Fatalf("Expected request to be signed with source credentials, got '%s'", auth)
+	}
+}
+
+func TestAssumeRoleRenewal(t *testing.T) {
+	f := &fakeSTS{ttl: shortLifetime}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	signal := newRefreshSignal()
+	provider, err := NewAssumeRoleCredentials(credentials.NewIamUserCredentials("AKID", "SECRET"), AssumeRoleOptions{
+		RoleArn:  "arn:aws:iam::123456789012:role/audio-reader",
+		Endpoint: server.URL,
+		Refresh:  credentials.RefreshOptions{Hooks: signal},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	signal.wait(t)
+	if f.requestCount() < 2 {
+		t.Fatal("Expected role to be assumed again before the credentials expire")
+	}
+	if retrieve(t, provider).AccessKeyId == "ASIAEXAMPLE1" {
+		t.Fatal("Expected renewed credentials to be returned")
+	}
+}
+
+func TestAssumeRoleDenied(t *testing.T) {
+	server := httptest.NewServer(&fakeSTS{deny: true})
+	defer server.Close()
+
+	_, err := NewAssumeRoleCredentials(credentials.NewIamUserCredentials("AKID", "SECRET"), AssumeRoleOptions{
+		RoleArn:  "arn:aws:iam::123456789012:role/audio-reader",
+		Endpoint: server.URL,
+	})
+	var awsErr *aws.Error
+	if !errors.As(err, &awsErr) || awsErr.Code != "AccessDenied" || awsErr.StatusCode != 403 {
+		t.Fatalf("Expected AccessDenied error, got %v", err)
+	}
+}
+
+func retrieve(t *testing.T, p credentials.Provider) credentials.Credentials {
+	creds, err := p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieving credentials failed: %s", err)
+	}
+	return creds
+}
@@ -0,0 +1,76 @@
+// Credentials providers backed by the AWS Security Token Service (STS).
+//
+// Temporary credentials obtained from STS plug into
+// credentials.Provider and are renewed in the background before
+// they expire, like EC2 role credentials.
+//
+// More info: http://docs.aws.amazon.com/STS/latest/APIReference/Welcome.html
+package sts
+
+import (
+	"context"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"time"
+)
+
+const (
+	stsEndpoint   = "https://sts.amazonaws.com"
+	stsApiVersion = "2011-06-15"
+	stsRegion     = "us-east-1"
+)
+
+// Temporary credentials as returned by STS
+type stsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+func (c stsCredentials) credentials() credentials.Credentials {
+	return credentials.Credentials{
+		AccessKeyId:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		Token:           c.SessionToken,
+		Expiration:      c.Expiration,
+	}
+}
+
+type client struct {
+	*aws.QueryClient
+}
+
+// Client for endpoint, or the regional endpoint of region, or the global
+// endpoint if neither is set. Without a region, requests to endpoint are
+// signed for the region derived from its host.
+func newClient(endpoint string, region string) (*client, error) {
+	if endpoint == "" && region != "" {
+		var err error
+		if endpoint, err = aws.ResolveEndpoint("sts", region); err != nil {
+			return nil, err
+		}
+	}
+	if endpoint == "" {
+		endpoint, region = stsEndpoint, stsRegion
+	}
+	c := aws.NewQueryClient(endpoint, "sts", region, stsApiVersion, nil)
+	c.HTTPClient.Timeout = 10 * time.Second
+	// Assuming a role again only creates another session
+	c.IdempotentActions = map[string]bool{"AssumeRole": true, "AssumeRoleWithWebIdentity": true}
+	return &client{c}, nil
+}
+
+// Call an STS action and decode its XML response into out. The request is
+// signed with creds, unless creds is nil.
+func (c *client) call(ctx context.Context, action string, params aws.QueryParams, creds credentials.Provider, out interface{}) error {
+	query := *c.QueryClient
+	query.Credentials = creds
+	return query.Call(ctx, action, params, out)
+}
+
+// Default session name, which identifies the session in CloudTrail
+func defaultSessionName() string {
+	return fmt.Sprintf("sc-gaws-%d", time.Now().UnixNano())
+}
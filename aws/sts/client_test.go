@@ -0,0 +1,25 @@
+package sts
+
+import (
+	"testing"
+)
+
+func TestNewClientRegion(t *testing.T) {
+	cases := []struct{ endpoint, region, expectedEndpoint, expectedRegion string }{
+		{"", "", "https://sts.amazonaws.com", "us-east-1"},
+		{"", "eu-west-1", "https://sts.eu-west-1.amazonaws.com", "eu-west-1"},
+		// Derived from the host when signing
+		{"https://sts.eu-west-1.amazonaws.com", "", "https://sts.eu-west-1.amazonaws.com", ""},
+		{"http://localhost:4566", "eu-west-1", "http://localhost:4566", "eu-west-1"},
+	}
+
+	for _, c := range cases {
+		client, err := newClient(c.endpoint, c.region)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Endpoint != c.expectedEndpoint || client.Region != c.expectedRegion {
+			t.Errorf("%q/%q: expected %s in %q, got %s in %q", c.endpoint, c.region, c.expectedEndpoint, c.expectedRegion, client.Endpoint, client.Region)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package sts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/soundcloud/sc-gaws/aws"
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// WebIdentityOptions configures the role to assume with a web identity token,
+// such as the projected service account token of a Kubernetes pod.
+type WebIdentityOptions struct {
+	// ARN of the role to assume
+	RoleArn string
+
+	// File holding the web identity token. It is read again whenever the
+	// credentials are renewed, so rotated tokens are picked up.
+	TokenFile string
+
+	// Name identifying the session. Defaults to a unique sc-gaws-* name.
+	RoleSessionName string
+
+	// Lifetime of the credentials. Defaults to 1 hour.
+	Duration time.Duration
+
+	// Inline session policy further restricting the role's permissions
+	Policy string
+
+	// STS endpoint and region to sign for. The regional endpoint is used if
+	// only Region is set, the global endpoint if neither is. The region is
+	// derived from the host if only Endpoint is set.
+	Endpoint string
+	Region   string
+
+	// How the credentials are renewed
+	Refresh credentials.RefreshOptions
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// Initialise temporary credentials for the role and token file configured
+// in AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE, as set up for EKS pods
+// with an IAM role for their service account. AWS_ROLE_SESSION_NAME and
+// AWS_REGION are used if set. Returns an error if the variables are not set
+// or the role could not be assumed.
+func NewWebIdentityCredentialsFromEnv() (*credentials.RefreshingCredentials, error) {
+	opts := WebIdentityOptions{
+		RoleArn:         os.Getenv("AWS_ROLE_ARN"),
+		TokenFile:       os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+		RoleSessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+	}
+	if opts.RoleArn == "" || opts.TokenFile == "" {
+		return nil, errors.New("AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE must be set")
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		opts.Region = region
+	}
+	return NewWebIdentityCredentials(opts)
+}
+
+// Initialise temporary credentials for a role assumed with the web identity
+// token in opts.TokenFile. The credentials are renewed before they expire.
+// Returns an error if the role could not be assumed.
+func NewWebIdentityCredentials(opts WebIdentityOptions) (*credentials.RefreshingCredentials, error) {
+	if opts.RoleArn == "" || opts.TokenFile == "" {
+		return nil, errors.New("RoleArn and TokenFile must be set to assume a role with a web identity")
+	}
+	if opts.RoleSessionName == "" {
+		opts.RoleSessionName = defaultSessionName()
+	}
+	c, err := newClient(opts.Endpoint, opts.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewRefreshingCredentialsWithOptions(func(ctx context.Context) (credentials.Credentials, error) {
+		params, err := webIdentityParams(opts)
+		if err != nil {
+			return credentials.Credentials{}, err
+		}
+
+		// The token authenticates the request, it is not signed
+		var res assumeRoleWithWebIdentityResponse
+		if err := c.call(ctx, "AssumeRoleWithWebIdentity", params, nil, &res); err != nil {
+			return credentials.Credentials{}, err
+		}
+		return res.Credentials.credentials(), nil
+	}, opts.Refresh)
+}
+
+func webIdentityParams(opts WebIdentityOptions) (aws.QueryParams, error) {
+	token, err := ioutil.ReadFile(opts.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read web identity token: %v", err)
+	}
+
+	params := aws.QueryParams{}
+	params.Set("RoleArn", opts.RoleArn)
+	params.Set("RoleSessionName", opts.RoleSessionName)
+	params.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+	if opts.Duration > 0 {
+		params.SetInt("DurationSeconds", int64(opts.Duration/time.Second))
+	}
+	if opts.Policy != "" {
+		params.Set("Policy", opts.Policy)
+	}
+	return params, nil
+}
@@ -0,0 +1,93 @@
+package sts
+
+import (
+	"github.com/soundcloud/sc-gaws/aws/credentials"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeToken(t *testing.T, path string, token string) {
+	if err := ioutil.WriteFile(path, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	f := &fakeSTS{ttl: shortLifetime}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeToken(t, tokenFile, "first-token\n")
+
+	signal := newRefreshSignal()
+	provider, err := NewWebIdentityCredentials(WebIdentityOptions{
+		RoleArn:         "arn:aws:iam::123456789012:role/pod-role",
+		TokenFile:       tokenFile,
+		RoleSessionName: "pod",
+		Endpoint:        server.URL,
+		Refresh:         credentials.RefreshOptions{Hooks: signal},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	if creds := retrieve(t, provider); !strings.HasPrefix(creds.AccessKeyId, "ASIAEXAMPLE") || creds.Token != "TOKEN" {
+		t.Fatalf("Unexpected credentials: %+v", creds)
+	}
+
+	// Renewed in the background meanwhile
+	f.mu.Lock()
+	form, auth := f.forms[0], f.requests[0].Header.Get("Authorization")
+	f.mu.Unlock()
+	if form.Get("Action") != "AssumeRoleWithWebIdentity" || form.Get("WebIdentityToken") != "first-token" ||
+		form.Get("RoleArn") != "arn:aws:iam::123456789012:role/pod-role" || form.Get("RoleSessionName") != "pod" {
+		t.Fatalf("Unexpected request parameters: %v", form)
+	}
+	if auth != "" {
+		t.Fatalf("Expected unsigned request, got Authorization '%s'", auth)
+	}
+
+	// Token rotated before the credentials are renewed. The first renewal
+	// signalled may have read the token before it was rotated.
+	writeToken(t, tokenFile, "second-token\n")
+	signal.wait(t)
+	signal.wait(t)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.forms) < 2 || f.forms[len(f.forms)-1].Get("WebIdentityToken") != "second-token" {
+		t.Fatal("Expected renewal to use the rotated token")
+	}
+}
+
+func TestWebIdentityCredentialsFromEnv(t *testing.T) {
+	for _, k := range []string{"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		old, ok := os.LookupEnv(k)
+		os.Unsetenv(k)
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, old)
+			}
+		})
+	}
+
+	if _, err := NewWebIdentityCredentialsFromEnv(); err == nil {
+		t.Fatal("Expected error without AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+}
+
+func TestWebIdentityMissingTokenFile(t *testing.T) {
+	_, err := NewWebIdentityCredentials(WebIdentityOptions{
+		RoleArn:   "arn:aws:iam::123456789012:role/pod-role",
+		TokenFile: filepath.Join(t.TempDir(), "missing"),
+	})
+	if err == nil {
+		t.Fatal("Expected error for missing token file")
+	}
+}
@@ -2,12 +2,15 @@
 // interface to consumers. Initialise a Stats struct with some intial
 // configuration and then call AccumulateAndPush.
 //
-//  m := make(chan stats.Metric)
-//  s := stats.NewStats(aws.AwsStatsPusher{Credentials: credentialsProvider, Namespace: "example"},10)
-//  go s.AccumulateAndPush(60*time.Second, m) // Update stats every 60s
+//	m := make(chan stats.Metric)
+//	s := stats.NewStats(aws.AwsStatsPusher{Credentials: credentialsProvider, Namespace: "example"},10)
+//	go s.AccumulateAndPush(60*time.Second, m) // Update stats every 60s
 package stats
 
 import (
+	"math"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -21,8 +24,133 @@ type Metric struct {
 	Value     float32
 	Unit      string
 	Timestamp time.Time
+
+	// Dimensions further identifying the metric, e.g. {"Host": "web-1"}.
+	// Metrics with the same name but different dimensions are separate
+	// series.
+	Dimensions map[string]string
+
+	// Summary of the samples accumulated into the metric in StatisticsMode.
+	// Value holds their average, or their sum for Count units.
+	Statistics *StatisticSet
+
+	// Sample values and how often each occurred, for metrics accumulated
+	// as histograms. Counts default to 1 if empty.
+	Values []float64
+	Counts []float64
+
+	// Resolution in seconds CloudWatch stores the metric with: 1 for high
+	// resolution, or 60 (the default) for standard resolution. Series of
+	// high-resolution metrics are pushed more often.
+	StorageResolution int
+}
+
+// Storage resolution of m as accepted by CloudWatch: 1 for any resolution
+// below one minute, 60 for longer ones, or 0 if not set.
+func (m Metric) Resolution() int {
+	switch {
+	case m.StorageResolution <= 0:
+		return 0
+	case m.StorageResolution < 60:
+		return 1
+	default:
+		return 60
+	}
+}
+
+// Whether m is stored with a resolution below one minute
+func (m Metric) HighResolution() bool {
+	return m.Resolution() == 1
+}
+
+// StatisticSet summarises the samples of a metric, so that statistics
+// calculated from accumulated metrics are exact.
+//
+// More info: http://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_StatisticSet.html
+type StatisticSet struct {
+	SampleCount float64
+	Sum         float64
+	Minimum     float64
+	Maximum     float64
+}
+
+// Summarise samples. Samples which are summaries themselves are merged.
+func statistics(samples []Metric) *StatisticSet {
+	set := &StatisticSet{}
+	for _, m := range samples {
+		s := m.Statistics
+		if s == nil {
+			s = sampleStatistics(m)
+		}
+		if set.SampleCount == 0 || s.Minimum < set.Minimum {
+			set.Minimum = s.Minimum
+		}
+		if set.SampleCount == 0 || s.Maximum > set.Maximum {
+			set.Maximum = s.Maximum
+		}
+		set.SampleCount += s.SampleCount
+		set.Sum += s.Sum
+	}
+	return set
+}
+
+// Statistic set of a single sample, or of the values of a histogram
+func sampleStatistics(m Metric) *StatisticSet {
+	if len(m.Values) == 0 {
+		v := float64(m.Value)
+		return &StatisticSet{SampleCount: 1, Sum: v, Minimum: v, Maximum: v}
+	}
+	set := &StatisticSet{Minimum: m.Values[0], Maximum: m.Values[0]}
+	for i, v := range m.Values {
+		n := 1.0
+		if i < len(m.Counts) {
+			n = m.Counts[i]
+		}
+		set.SampleCount += n
+		set.Sum += v * n
+		set.Minimum = math.Min(set.Minimum, v)
+		set.Maximum = math.Max(set.Maximum, v)
+	}
+	return set
+}
+
+// Key identifying the series of m by its name and dimensions
+func (m Metric) series() string {
+	if len(m.Dimensions) == 0 {
+		return m.Name
+	}
+	dims := make([]string, 0, len(m.Dimensions))
+	for k, v := range m.Dimensions {
+		dims = append(dims, k+"="+v)
+	}
+	sort.Strings(dims)
+	return m.Name + "\x00" + strings.Join(dims, "\x00")
 }
 
+// AccumulateMode decides how the samples of a series are accumulated.
+type AccumulateMode int
+
+const (
+	// Average samples, or sum them for Count units, in groups of
+	// AccumulateLimit samples
+	AverageMode AccumulateMode = iota
+
+	// Summarise all samples of a series in one StatisticSet per push, so
+	// that its minimum, maximum and sample count are kept
+	StatisticsMode
+)
+
+// Default for Stats.HighResolutionFrequency
+const defaultHighResolutionFrequency = 5 * time.Second
+
+// Maximum number of values of a metric accumulated as a histogram, as
+// accepted by CloudWatch. Neighbouring buckets are merged to stay below it.
+const MaxHistogramValues = 150
+
+// Ratio between the bounds of a histogram bucket, so that samples are
+// counted with a precision of about 10% however large they are
+const histogramBucketRatio = 1.1
+
 // Stats pusher is an interface that wraps a method Push that can be called to
 // push metrics to an aggregator of some kind, like AWS Cloudwatch
 type StatsPusher interface {
@@ -38,31 +166,59 @@ type Stats struct {
 
 	// Number of samples that will be accumulated to create one metric for
 	// sending upstream.  This is to prevent pushing too many metrics.
+	// Only used in AverageMode.
 	AccumulateLimit int
 
-	// Samples currently being collected
+	// How samples are accumulated. Defaults to AverageMode.
+	Mode AccumulateMode
+
+	// Names of metrics whose samples are accumulated as histograms instead,
+	// e.g. response times, so that percentiles can be calculated from them
+	Histograms map[string]bool
+
+	// How often series of high-resolution metrics are pushed. Defaults to 5
+	// seconds, or the frequency of the other series if that is shorter.
+	HighResolutionFrequency time.Duration
+
+	// Samples currently being collected, by series
 	currentSamples map[string][]Metric
 }
 
 func NewStats(pusher StatsPusher, accumulateLimit int) *Stats {
 	return &Stats{
-		pusher,
-		accumulateLimit,
-		make(map[string][]Metric),
+		Pusher:          pusher,
+		AccumulateLimit: accumulateLimit,
+		currentSamples:  make(map[string][]Metric),
 	}
 }
 
 // Add a metric to the Stats struct, with averaging applied.
 func (s *Stats) addMetric(m Metric) {
-	s.currentSamples[m.Name] = append(s.currentSamples[m.Name], m)
+	key := m.series()
+	s.currentSamples[key] = append(s.currentSamples[key], m)
 }
 
 func (s *Stats) accumulate() []Metric {
+	return s.accumulateWhere(func(Metric) bool { return true })
+}
+
+// Accumulate the series whose latest sample matches include
+func (s *Stats) accumulateWhere(include func(Metric) bool) []Metric {
 	var allMetrics []Metric
-	for name, metrics := range s.currentSamples {
+	for key, metrics := range s.currentSamples {
 
-		if len(metrics) == 0 {
-			// Nothing to accumulate
+		if !include(metrics[len(metrics)-1]) {
+			// Pushed at the other frequency
+			continue
+		}
+		if s.Histograms[metrics[0].Name] {
+			allMetrics = append(allMetrics, histogram(metrics))
+			delete(s.currentSamples, key)
+			continue
+		}
+		if s.Mode == StatisticsMode {
+			allMetrics = append(allMetrics, summary(metrics))
+			delete(s.currentSamples, key)
 			continue
 		}
 		n := len(metrics) / s.AccumulateLimit
@@ -90,34 +246,153 @@ func (s *Stats) accumulate() []Metric {
 				for _, v := range currMetrics {
 					sum += v.Value
 				}
-				allMetrics = append(allMetrics, Metric{m.Name, sum, m.Unit, m.Timestamp})
+				allMetrics = append(allMetrics, Metric{Name: m.Name, Value: sum, Unit: m.Unit, Timestamp: m.Timestamp, Dimensions: m.Dimensions, StorageResolution: m.StorageResolution})
 			default:
 				sum := float32(0.0)
 				for _, v := range currMetrics {
 					sum += v.Value
 				}
 				avg := sum / float32(len(currMetrics))
-				allMetrics = append(allMetrics, Metric{m.Name, avg, m.Unit, m.Timestamp})
+				allMetrics = append(allMetrics, Metric{Name: m.Name, Value: avg, Unit: m.Unit, Timestamp: m.Timestamp, Dimensions: m.Dimensions, StorageResolution: m.StorageResolution})
 			}
 		}
-		s.currentSamples[name] = metrics[:0]
+		// Series are only kept while they have samples, as there may be
+		// many short-lived dimension values
+		delete(s.currentSamples, key)
 	}
 	return allMetrics
 }
 
+// Summarise samples into one metric holding their statistic set. Samples
+// which are histograms are summarised from their values.
+func summary(samples []Metric) Metric {
+	// Use last metric in sample as reference
+	ref := samples[len(samples)-1]
+	set := statistics(samples)
+	m := Metric{Name: ref.Name, Unit: ref.Unit, Timestamp: ref.Timestamp, Dimensions: ref.Dimensions, Statistics: set, StorageResolution: ref.StorageResolution}
+	if m.Unit == "Count" {
+		m.Value = float32(set.Sum)
+	} else {
+		m.Value = float32(set.Sum / set.SampleCount)
+	}
+	return m
+}
+
+// Samples counted in a histogram bucket
+type bucket struct {
+	count float64
+	sum   float64
+}
+
+// Index of the bucket counting v. Buckets of negative values mirror those of
+// positive ones, and zero has a bucket of its own.
+func bucketIndex(v float64) int {
+	if v == 0 {
+		return 0
+	}
+	i := int(math.Round(math.Log(math.Abs(v))/math.Log(histogramBucketRatio))) + math.MaxInt16
+	if v < 0 {
+		return -i
+	}
+	return i
+}
+
+// Count samples in log-scale buckets, merging samples which are histograms
+// themselves, into a metric of at most MaxHistogramValues values. Each
+// bucket is pushed as the average of its samples.
+func histogram(samples []Metric) Metric {
+	buckets := map[int]*bucket{}
+	add := func(v float64, n float64) {
+		if n <= 0 {
+			return
+		}
+		i := bucketIndex(v)
+		if buckets[i] == nil {
+			buckets[i] = &bucket{}
+		}
+		buckets[i].count += n
+		buckets[i].sum += v * n
+	}
+	for _, m := range samples {
+		if len(m.Values) == 0 {
+			if s := m.Statistics; s != nil {
+				// Only the average of summarized samples is known
+				add(s.Sum/s.SampleCount, s.SampleCount)
+			} else {
+				add(float64(m.Value), 1)
+			}
+			continue
+		}
+		for i, v := range m.Values {
+			if i < len(m.Counts) {
+				add(v, m.Counts[i])
+			} else {
+				add(v, 1)
+			}
+		}
+	}
+	indexes := make([]int, 0, len(buckets))
+	for i := range buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	sorted := make([]bucket, len(indexes))
+	for j, i := range indexes {
+		sorted[j] = *buckets[i]
+	}
+
+	// Halve the resolution until the buckets fit into one metric
+	for len(sorted) > MaxHistogramValues {
+		merged := sorted[:0]
+		for j := 0; j < len(sorted); j += 2 {
+			b := sorted[j]
+			if j+1 < len(sorted) {
+				b.count += sorted[j+1].count
+				b.sum += sorted[j+1].sum
+			}
+			merged = append(merged, b)
+		}
+		sorted = merged
+	}
+
+	m := summary(samples)
+	m.Values = make([]float64, len(sorted))
+	m.Counts = make([]float64, len(sorted))
+	for j, b := range sorted {
+		m.Values[j] = b.sum / b.count
+		m.Counts[j] = b.count
+	}
+	return m
+}
+
 // Listen for metrics on metricsChan, accumulate and push metrics upstream. The
-// duration of pushing can be controlled by statsUpdateFrequency.
+// duration of pushing can be controlled by statsUpdateFrequency, and by
+// HighResolutionFrequency for high-resolution metrics.
 func (s *Stats) AccumulateAndPush(statsUpdateFrequency time.Duration, metricChan <-chan Metric) {
+	highResolutionFrequency := s.HighResolutionFrequency
+	if highResolutionFrequency <= 0 {
+		highResolutionFrequency = defaultHighResolutionFrequency
+	}
+	if statsUpdateFrequency < highResolutionFrequency {
+		highResolutionFrequency = statsUpdateFrequency
+	}
+
 	t := time.Tick(statsUpdateFrequency)
+	highResolution := time.Tick(highResolutionFrequency)
 	for {
 		select {
 		case <-t:
-			metrics := s.accumulate()
-			if len(metrics) > 0 {
-				go s.Pusher.Push(metrics)
-			}
+			s.push(s.accumulateWhere(func(m Metric) bool { return !m.HighResolution() }))
+		case <-highResolution:
+			s.push(s.accumulateWhere(Metric.HighResolution))
 		case m := <-metricChan:
 			s.addMetric(m)
 		}
 	}
 }
+
+func (s *Stats) push(metrics []Metric) {
+	if len(metrics) > 0 {
+		go s.Pusher.Push(metrics)
+	}
+}
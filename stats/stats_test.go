@@ -137,6 +137,153 @@ func TestCountMetrics(t *testing.T) {
 	}
 }
 
+func TestDimensions(t *testing.T) {
+	s := NewStats(&MockStatsPusher{}, accumulateLimit)
+	s.addMetric(Metric{Name: "Latency", Value: 10, Dimensions: map[string]string{"Host": "web-1", "Endpoint": "/tracks"}})
+	s.addMetric(Metric{Name: "Latency", Value: 20, Dimensions: map[string]string{"Endpoint": "/tracks", "Host": "web-1"}})
+	s.addMetric(Metric{Name: "Latency", Value: 50, Dimensions: map[string]string{"Host": "web-2", "Endpoint": "/tracks"}})
+	s.addMetric(Metric{Name: "Latency", Value: 100})
+
+	values := map[string]float32{}
+	for _, m := range s.accumulate() {
+		values[m.Dimensions["Host"]] = m.Value
+	}
+	if len(values) != 3 || values["web-1"] != 15 || values["web-2"] != 50 || values[""] != 100 {
+		t.Fatalf("Expected series with different dimensions to be kept apart, got %v", values)
+	}
+	if len(s.currentSamples) != 0 {
+		t.Fatalf("Expected pushed series to be removed, got %d", len(s.currentSamples))
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	s := NewStats(&MockStatsPusher{}, 2)
+	s.Mode = StatisticsMode
+	for _, v := range []float32{20, 5, 30, 25} {
+		s.addMetric(Metric{Name: "Latency", Value: v, Unit: "Milliseconds"})
+	}
+	// Summary accumulated elsewhere
+	s.addMetric(Metric{Name: "Latency", Unit: "Milliseconds", Statistics: &StatisticSet{SampleCount: 2, Sum: 110, Minimum: 10, Maximum: 100}})
+
+	metrics := s.accumulate()
+	if len(metrics) != 1 || metrics[0].Statistics == nil {
+		t.Fatalf("Expected one metric with statistics, got %+v", metrics)
+	}
+	expected := StatisticSet{SampleCount: 6, Sum: 190, Minimum: 5, Maximum: 100}
+	if *metrics[0].Statistics != expected || metrics[0].Value != float32(190.0/6) {
+		t.Fatalf("Expected statistics %+v, got %+v with value %f", expected, *metrics[0].Statistics, metrics[0].Value)
+	}
+
+	// Without statistics in AverageMode
+	s.Mode = AverageMode
+	s.addMetric(Metric{Name: "Latency", Value: 10})
+	if metrics := s.accumulate(); len(metrics) != 1 || metrics[0].Statistics != nil {
+		t.Fatalf("Expected average without statistics, got %+v", metrics)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	s := NewStats(&MockStatsPusher{}, accumulateLimit)
+	s.Histograms = map[string]bool{"Latency": true}
+	for _, v := range []float32{20, 5, 20, 30, 5, 19, 0} {
+		s.addMetric(Metric{Name: "Latency", Value: v, Unit: "Milliseconds"})
+	}
+	s.addMetric(Metric{Name: "Latency", Unit: "Milliseconds", Values: []float64{5, 100}, Counts: []float64{2, 1}})
+	s.addMetric(Metric{Name: "Requests", Value: 3, Unit: "Count"})
+
+	metrics := s.accumulate()
+	if len(metrics) != 2 {
+		t.Fatalf("Expected a histogram and a count, got %+v", metrics)
+	}
+	m := metrics[0]
+	if m.Name != "Latency" {
+		m = metrics[1]
+	}
+	// 19 and 20 share a bucket
+	if fmt.Sprint(m.Values, m.Counts) != "[0 5 19.666666666666668 30 100] [1 4 3 1 1]" {
+		t.Fatalf("Unexpected histogram: values %v, counts %v", m.Values, m.Counts)
+	}
+	expected := StatisticSet{SampleCount: 10, Sum: 209, Minimum: 0, Maximum: 100}
+	if *m.Statistics != expected || m.Value != float32(20.9) {
+		t.Fatalf("Expected statistics %+v, got %+v with value %f", expected, *m.Statistics, m.Value)
+	}
+}
+
+func TestHistogramStatistics(t *testing.T) {
+	s := NewStats(&MockStatsPusher{}, accumulateLimit)
+	s.Histograms = map[string]bool{"Latency": true}
+	s.addMetric(Metric{Name: "Latency", Value: 10, Unit: "Milliseconds"})
+	s.addMetric(Metric{Name: "Latency", Value: 55, Unit: "Milliseconds", Statistics: &StatisticSet{SampleCount: 4, Sum: 220, Minimum: 10, Maximum: 100}})
+
+	metrics := s.accumulate()
+	if len(metrics) != 1 {
+		t.Fatalf("Expected one histogram, got %+v", metrics)
+	}
+	m := metrics[0]
+	if fmt.Sprint(m.Values, m.Counts) != "[10 55] [1 4]" {
+		t.Fatalf("Unexpected histogram: values %v, counts %v", m.Values, m.Counts)
+	}
+	expected := StatisticSet{SampleCount: 5, Sum: 230, Minimum: 10, Maximum: 100}
+	if *m.Statistics != expected {
+		t.Fatalf("Expected statistics %+v, got %+v", expected, *m.Statistics)
+	}
+}
+
+func TestHistogramValueLimit(t *testing.T) {
+	s := NewStats(&MockStatsPusher{}, accumulateLimit)
+	s.Histograms = map[string]bool{"Latency": true}
+	for i := 0; i < 10000; i++ {
+		s.addMetric(Metric{Name: "Latency", Value: float32(i) * 10})
+		s.addMetric(Metric{Name: "Latency", Value: -float32(i)})
+	}
+
+	metrics := s.accumulate()
+	if len(metrics) != 1 {
+		t.Fatalf("Expected one histogram, got %d metrics", len(metrics))
+	}
+	m := metrics[0]
+	if len(m.Values) > MaxHistogramValues || len(m.Counts) != len(m.Values) {
+		t.Fatalf("Expected at most %d values, got %d", MaxHistogramValues, len(m.Values))
+	}
+	total := 0.0
+	for i, c := range m.Counts {
+		total += c
+		if i > 0 && m.Values[i] <= m.Values[i-1] {
+			t.Fatalf("Expected sorted values, got %v", m.Values)
+		}
+	}
+	if total != 20000 || m.Statistics.SampleCount != 20000 || m.Statistics.Maximum != 99990 {
+		t.Fatalf("Expected all samples to be counted, got %f: %+v", total, *m.Statistics)
+	}
+}
+
+// Pusher sending pushed metrics to a channel
+type chanStatsPusher chan []Metric
+
+func (c chanStatsPusher) Push(metrics []Metric) {
+	c <- metrics
+}
+
+func TestHighResolutionFrequency(t *testing.T) {
+	pushed := make(chanStatsPusher, 10)
+	s := NewStats(pushed, accumulateLimit)
+	s.HighResolutionFrequency = 100 * time.Millisecond
+	m := make(chan Metric)
+	go s.AccumulateAndPush(time.Hour, m)
+
+	m <- Metric{Name: "Standard", Value: 1}
+	m <- Metric{Name: "HighResolution", Value: 2, StorageResolution: 1}
+
+	select {
+	case metrics := <-pushed:
+		if len(metrics) != 1 || metrics[0].Name != "HighResolution" || metrics[0].StorageResolution != 1 {
+			t.Fatalf("Expected only the high-resolution metric to be pushed, got %+v", metrics)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected high-resolution metric to be pushed")
+	}
+}
+
 func generateRandomMetrics(count int, name string, unit string) (metrics []Metric) {
 
 	for i := 0; i < count; i++ {